@@ -10,6 +10,8 @@ import (
 	"os"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -34,6 +36,8 @@ var app *gowid.App
 var term *terminal.Widget
 var code string
 var saveDir string
+var startDir string
+var mode wormflow.Mode
 var session string
 var shell string
 var openCmd string
@@ -58,6 +62,19 @@ func envTrue(val string) bool {
 	}
 }
 
+// codesRegexp matches any of codes. Longer codes go first so that a code which is a prefix
+// of another doesn't hide it.
+func codesRegexp(codes []string) string {
+	quoted := make([]string, 0, len(codes))
+	for _, c := range codes {
+		quoted = append(quoted, regexp.QuoteMeta(c))
+	}
+	sort.SliceStable(quoted, func(i, j int) bool {
+		return len(quoted[i]) > len(quoted[j])
+	})
+	return strings.Join(quoted, "|")
+}
+
 func quit(app gowid.IApp) {
 	if !willQuit {
 		willQuit = true
@@ -76,7 +93,10 @@ func (h handler) UnhandledInput(app gowid.IApp, ev interface{}) bool {
 		switch evk.Key() {
 		case tcell.KeyCtrlC, tcell.KeyEsc:
 			handled = true
-			quit(app)
+			// First press aborts a transfer in progress; the UI then shows the outcome
+			if !h.controller.Cancel(app) {
+				quit(app)
+			}
 		}
 	}
 	return handled
@@ -94,6 +114,12 @@ func cmain() int {
 		return 1
 	}
 
+	mode, err = wormflow.ParseMode(os.Getenv("TMUX_WORMHOLE_MODE"))
+	if err != nil {
+		fmt.Printf("Problem with TMUX_WORMHOLE_MODE: %v\n", err)
+		return 1
+	}
+
 	code = os.Getenv("TMUX_WORMHOLE_CODE")
 	// If code is empty, it means the bash wrapper didn't find one. Show that error in the UI
 	// which means we need to launch the UI first. But I do assume that what is provided is
@@ -104,6 +130,22 @@ func cmain() int {
 		return 1
 	}
 
+	// Every distinct code in the pane, oldest first. If there's more than one, each is labelled
+	// and the user picks. The most recent gets the first label, which is the easiest to type.
+	codes := strings.Fields(os.Getenv("TMUX_WORMHOLE_CODES"))
+	var paneHints, pickHints map[string]string
+	if len(codes) > 1 {
+		codeRe = regexp.MustCompile(codesRegexp(codes))
+		paneHints = make(map[string]string)
+		pickHints = make(map[string]string)
+		labels := hilite.Labels(len(codes))
+		for i, c := range codes {
+			label := labels[len(codes)-1-i]
+			paneHints[c] = label
+			pickHints[label] = c
+		}
+	}
+
 	session = os.Getenv("TMUX_WORMHOLE_SESSION")
 	if session == "" {
 		fmt.Printf("This tmux plugin requires a value in the env variable TMUX_WORMHOLE_SESSION.\n")
@@ -125,6 +167,15 @@ func cmain() int {
 		}
 	}
 
+	// The sender's file browser starts in the directory of the pane tmux-wormhole was launched from
+	startDir = os.Getenv("TMUX_WORMHOLE_START_DIR")
+	if startDir == "" {
+		startDir, err = os.Getwd()
+		if err != nil {
+			startDir = "."
+		}
+	}
+
 	// Takes precedence
 	openCmd = os.Getenv("TMUX_WORMHOLE_OPEN_CMD")
 	if openCmd == "" && !envTrue(os.Getenv("TMUX_WORMHOLE_NO_DEFAULT_OPEN")) {
@@ -136,6 +187,100 @@ func cmain() int {
 		}
 	}
 
+	// The servers from @wormhole-rendezvous-url and @wormhole-transit-relay come first. If
+	// neither is set, that's the public servers. Then any from @wormhole-profiles.
+	profiles := []wormflow.Profile{{
+		Name:          "default",
+		RendezvousURL: os.Getenv("TMUX_WORMHOLE_RENDEZVOUS_URL"),
+		TransitRelay:  os.Getenv("TMUX_WORMHOLE_TRANSIT_RELAY"),
+	}}
+	if profiles[0].RendezvousURL == "" && profiles[0].TransitRelay == "" {
+		profiles[0].Name = "public"
+	}
+
+	named, err := wormflow.ParseProfiles(os.Getenv("TMUX_WORMHOLE_PROFILES"))
+	if err != nil {
+		fmt.Printf("Problem with @wormhole-profiles: %v\n", err)
+		return 1
+	}
+	profiles = append(profiles, named...)
+
+	profile := 0
+	if name := os.Getenv("TMUX_WORMHOLE_PROFILE"); name != "" {
+		profile = -1
+		for i, p := range profiles {
+			if p.Name == name {
+				profile = i
+				break
+			}
+		}
+		if profile == -1 {
+			fmt.Printf("Profile %s from @wormhole-profile is not defined.\n", name)
+			return 1
+		}
+	}
+
+	// Protection against zip bombs. An empty option means the default, 0 means no limit.
+	limits := wormflow.DefaultLimits
+	if s := os.Getenv("TMUX_WORMHOLE_MAX_DIR_SIZE"); s != "" {
+		if limits.MaxBytes, err = wormflow.ParseSize(s); err != nil {
+			fmt.Printf("Problem with @wormhole-max-dir-size: %v\n", err)
+			return 1
+		}
+	}
+	if s := os.Getenv("TMUX_WORMHOLE_MAX_DIR_FILES"); s != "" {
+		if limits.MaxFiles, err = strconv.Atoi(s); err != nil || limits.MaxFiles < 0 {
+			fmt.Printf("Problem with @wormhole-max-dir-files: %s is not a number of files\n", s)
+			return 1
+		}
+	}
+	if s := os.Getenv("TMUX_WORMHOLE_MAX_DIR_RATIO"); s != "" {
+		if limits.MaxRatio, err = strconv.ParseFloat(s, 64); err != nil || limits.MaxRatio < 0 {
+			fmt.Printf("Problem with @wormhole-max-dir-ratio: %s is not a ratio\n", s)
+			return 1
+		}
+	}
+
+	// Every transfer is logged here, for the history browser
+	history := ""
+	if !envTrue(os.Getenv("TMUX_WORMHOLE_NO_HISTORY")) {
+		if history, err = xdg.StateFile("tmux-wormhole/history.jsonl"); err != nil {
+			history = ""
+		}
+	}
+
+	// What to do with each offer, if there's a receive policy - in ~/.config/tmux-wormhole, or
+	// for everyone on the machine, in /etc/xdg/tmux-wormhole
+	var policy *wormflow.Policy
+	if file, err := xdg.SearchConfigFile("tmux-wormhole/policy.json"); err == nil {
+		if policy, err = wormflow.LoadPolicy(file); err != nil {
+			fmt.Printf("Problem with %s: %v\n", file, err)
+			return 1
+		}
+	}
+
+	// The host the pane is on - wherever it's logged in to with ssh, otherwise this one
+	host := wormflow.SSHHost(os.Getenv("TMUX_WORMHOLE_SSH_CMD"))
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+
+	// Run once something is received
+	hooks := wormflow.Hooks{
+		File:      os.Getenv("TMUX_WORMHOLE_HOOK_FILE"),
+		Directory: os.Getenv("TMUX_WORMHOLE_HOOK_DIR"),
+		Text:      os.Getenv("TMUX_WORMHOLE_HOOK_TEXT"),
+	}
+
+	// What the pane held, to look for a SHA-256 printed next to the code
+	pane, _ := ioutil.ReadFile(os.Getenv("TMUX_WORMHOLE_TMP_FILE"))
+
+	copyTo, err := wormflow.ParseCopyMode(os.Getenv("TMUX_WORMHOLE_COPY_TO"))
+	if err != nil {
+		fmt.Printf("Problem with @wormhole-copy-to: %v\n", err)
+		return 1
+	}
+
 	// Avoid gowid's dim screen problem with truecolor - need to fix
 	os.Setenv("COLORTERM", "")
 
@@ -171,13 +316,16 @@ func cmain() int {
 
 	// Don't want any user input going to the pane below the dialog, which is really
 	// a mock-up of the pane that was being displayed before the plugin ran.
+	hl := hilite.New(term, codeRe, hilite.Options{
+		Background:     gowid.ColorGreen,
+		Foreground:     gowid.ColorBlack,
+		HintBackground: gowid.ColorBlack,
+		HintForeground: gowid.ColorYellow,
+	})
+	hl.Hints = paneHints
+
 	h := holder.New(
-		selectable.NewUnselectable(
-			hilite.New(term, codeRe, hilite.Options{
-				Background: gowid.ColorGreen,
-				Foreground: gowid.ColorBlack,
-			}),
-		),
+		selectable.NewUnselectable(hl),
 	)
 
 	log := logrus.New()
@@ -194,14 +342,39 @@ func cmain() int {
 		return 1
 	}
 
+	// Just highlight the chosen code from now on
+	onPick := func(code string) {
+		hl.Match = regexp.MustCompile(regexp.QuoteMeta(code))
+		hl.Hints = nil
+	}
+
 	controller := wormflow.New(wormflow.Args{
-		Code:      code,
-		SaveDir:   saveDir,
-		OpenCmd:   openCmd,
-		NoAskOpen: envTrue(os.Getenv("TMUX_WORMHOLE_NO_ASK_TO_OPEN")),
-		Overwrite: envTrue(os.Getenv("TMUX_WORMHOLE_CAN_OVERWRITE")),
-		Shell:     shell,
-		Lower:     h,
+		Mode:        mode,
+		Code:        code,
+		Hints:       pickHints,
+		OnPick:      onPick,
+		Words:       strings.Fields(os.Getenv("TMUX_WORMHOLE_PGP_WORDS")),
+		SaveDir:     saveDir,
+		StartDir:    startDir,
+		OpenCmd:     openCmd,
+		Profiles:    profiles,
+		Profile:     profile,
+		NoAskOpen:   envTrue(os.Getenv("TMUX_WORMHOLE_NO_ASK_TO_OPEN")),
+		Overwrite:   envTrue(os.Getenv("TMUX_WORMHOLE_CAN_OVERWRITE")),
+		Limits:      limits,
+		CopyTo:      copyTo,
+		PasteBuffer: os.Getenv("TMUX_WORMHOLE_PASTE_BUFFER"),
+		History:     history,
+		Pane:        string(pane),
+		Sidecar:     envTrue(os.Getenv("TMUX_WORMHOLE_SHA256_SIDECAR")),
+		Policy:      policy,
+		Host:        host,
+		Hooks:       hooks,
+		PaneID:      os.Getenv("TMUX_WORMHOLE_PANE_ID"),
+		Extract:     envTrue(os.Getenv("TMUX_WORMHOLE_EXTRACT_ARCHIVES")),
+		DropArchive: envTrue(os.Getenv("TMUX_WORMHOLE_REMOVE_EXTRACTED_ARCHIVE")),
+		Shell:       shell,
+		Lower:       h,
 	})
 
 	controller.Start(app)
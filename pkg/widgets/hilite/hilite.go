@@ -15,13 +15,16 @@ import (
 //======================================================================
 
 type Options struct {
-	Background gowid.TCellColor
-	Foreground gowid.TCellColor
+	Background     gowid.TCellColor
+	Foreground     gowid.TCellColor
+	HintBackground gowid.TCellColor
+	HintForeground gowid.TCellColor
 }
 
 type Widget struct {
 	gowid.IWidget
 	Match *regexp.Regexp
+	Hints map[string]string // matched text -> label drawn over the start of the match
 	Opt   Options
 }
 
@@ -35,8 +38,10 @@ func New(inner gowid.IWidget, re *regexp.Regexp, opts ...Options) *Widget {
 		opt = opts[0]
 	} else {
 		opt = Options{
-			Background: gowid.ColorLightGreen,
-			Foreground: gowid.ColorBlack,
+			Background:     gowid.ColorLightGreen,
+			Foreground:     gowid.ColorBlack,
+			HintBackground: gowid.ColorBlack,
+			HintForeground: gowid.ColorYellow,
 		}
 	}
 
@@ -68,11 +73,47 @@ func (w *Widget) Render(size gowid.IRenderSize, focus gowid.Selector, app gowid.
 			y = j / wid
 			res.SetCellAt(x, y, res.CellAt(x, y).WithBackgroundColor(w.Opt.Background).WithForegroundColor(w.Opt.Foreground))
 		}
+
+		// Like tmux-thumbs, draw the label over the first characters of the match
+		if hint, ok := w.Hints[string(cbytes[m[0]:m[1]])]; ok {
+			for i, r := range hint {
+				j := m[0] + i
+				if j >= m[1] {
+					break
+				}
+				x = j % wid
+				y = j / wid
+				res.SetCellAt(x, y, res.CellAt(x, y).WithRune(r).WithBackgroundColor(w.Opt.HintBackground).WithForegroundColor(w.Opt.HintForeground))
+			}
+		}
 	}
 
 	return res
 }
 
+// Labels returns n distinct short labels, suitable for typing to pick one of n matches.
+// They are single keys where possible, then pairs of keys, then triples and so on - all the
+// same length, so none is the start of another.
+func Labels(n int) []string {
+	const alphabet = "asdfqwerzxcvjklmiuopghtybn"
+
+	size := 1
+	for total := len(alphabet); total < n; total *= len(alphabet) {
+		size++
+	}
+
+	res := make([]string, 0, n)
+	label := make([]byte, size)
+	for i := 0; i < n; i++ {
+		// i in base len(alphabet), most significant key first
+		for j, k := size-1, i; j >= 0; j, k = j-1, k/len(alphabet) {
+			label[j] = alphabet[k%len(alphabet)]
+		}
+		res = append(res, string(label))
+	}
+	return res
+}
+
 func canvasToArray(c gowid.ICanvas) []byte {
 	res := make([]byte, c.BoxRows()*c.BoxColumns())
 	var r rune
@@ -0,0 +1,323 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+//======================================================================
+
+// Archives that are extracted once received, if @wormhole-extract-archives is set - by the end
+// of their name, ignoring case. The longer endings come first.
+var archiveFormats = []struct {
+	suffix string
+	format string
+}{
+	{".tar.gz", "tar.gz"},
+	{".tgz", "tar.gz"},
+	{".tar.zst", "tar.zst"},
+	{".tzst", "tar.zst"},
+	{".tar", "tar"},
+	{".zip", "zip"},
+}
+
+// archiveFormat returns the format of the archive called name, and name without the ending
+// that says so. The format is empty if it isn't an archive that can be extracted.
+func archiveFormat(name string) (string, string) {
+	lower := strings.ToLower(name)
+	for _, a := range archiveFormats {
+		if strings.HasSuffix(lower, a.suffix) {
+			return a.format, name[:len(name)-len(a.suffix)]
+		}
+	}
+	return "", name
+}
+
+// extractReceived extracts the file name in d, if it's an archive, into a new directory next
+// to it named after it - e.g. foo.tar.gz into foo, or foo (1) if there's already a foo. The
+// directory receive's protections apply - the limits, the free space check, and the checks on
+// every name and symlink. It's extracted into a hidden directory first, as a directory is, so
+// the new directory only appears once it's complete. If it fails, nothing's left behind; the
+// archive is always left alone. It returns the new directory, which is empty if name isn't an
+// archive.
+func extractReceived(ctx context.Context, d *saveDir, name string, l Limits, ep *extractProgress) (string, error) {
+	format, base := archiveFormat(name)
+	if format == "" {
+		return "", nil
+	}
+	if base == "" {
+		base = "archive"
+	}
+
+	// Opened once, through d - both passes over a tar read this same file
+	f, err := d.open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	var a archive
+	switch format {
+	case "zip":
+		zr, err := zip.NewReader(f, info.Size())
+		if err != nil {
+			return "", err
+		}
+		if err := l.checkZip(zr); err != nil {
+			return "", err
+		}
+		a = zipArchive{zr}
+	default:
+		open := func() (*tarStream, error) { return openTar(io.NewSectionReader(f, 0, info.Size()), format) }
+		ta, err := newTarArchive(open, l)
+		if err != nil {
+			return "", err
+		}
+		if err := l.checkEntries(ta.entries(), uint64(info.Size())); err != nil {
+			return "", err
+		}
+		a = ta
+	}
+
+	// The archive's already here, so there only needs to be room for what's in it
+	if err := d.checkSpace(extractedSize(a.entries())); err != nil {
+		return "", err
+	}
+
+	tmpDir, err := d.mkdirPartial(base)
+	if err != nil {
+		return "", err
+	}
+	if err := extractArchive(ctx, a, d, tmpDir, ep); err != nil {
+		return "", d.discard(tmpDir, err)
+	}
+
+	dirName := base
+	if d.exists(dirName) {
+		dirName = numberedName(d, dirName)
+	}
+	if err := d.place(tmpDir, dirName, replaceNothing); err != nil {
+		return "", d.discard(tmpDir, err)
+	}
+	return d.join(dirName), nil
+}
+
+//======================================================================
+
+// tarArchive is a tar, maybe compressed, for extractArchive. A tar can only be read from
+// start to end, so it's read twice - once for the headers, which are checked before anything
+// is written, then again to extract it.
+type tarArchive struct {
+	open    func() (*tarStream, error)
+	headers []archiveEntry
+}
+
+// newTarArchive reads the headers. It stops as soon as the limits are crossed, rather than
+// reading the rest of what might be a bomb.
+func newTarArchive(open func() (*tarStream, error), l Limits) (*tarArchive, error) {
+	ts, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer ts.Close()
+
+	res := &tarArchive{open: open}
+	var total uint64
+	tr := tar.NewReader(ts)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		e := tarEntry(hdr)
+		res.headers = append(res.headers, e)
+		total += e.size
+		if err := l.checkFiles(len(res.headers)); err != nil {
+			return nil, err
+		}
+		if l.MaxBytes > 0 && (e.size > uint64(l.MaxBytes) || total > uint64(l.MaxBytes)) {
+			return nil, l.tooBig()
+		}
+	}
+
+	if err := ts.finish(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func tarEntry(hdr *tar.Header) archiveEntry {
+	e := archiveEntry{
+		name:    hdr.Name,
+		mode:    hdr.FileInfo().Mode(),
+		modTime: hdr.ModTime,
+	}
+	if hdr.Size > 0 {
+		e.size = uint64(hdr.Size)
+	}
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		e.link = hdr.Linkname
+		if e.link == "" {
+			// A link to nowhere - refused, like anything else extractArchive doesn't know
+			e.mode |= os.ModeIrregular
+		}
+	case tar.TypeLink:
+		// A hard link looks like a regular file, but isn't one - and could point anywhere
+		e.mode |= os.ModeIrregular
+	}
+	return e
+}
+
+func (t *tarArchive) entries() []archiveEntry {
+	return t.headers
+}
+
+func (t *tarArchive) each(fn func(i int, r io.Reader) error) error {
+	ts, err := t.open()
+	if err != nil {
+		return err
+	}
+	defer ts.Close()
+
+	tr := tar.NewReader(ts)
+	i := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		// What's extracted has to be what was checked
+		if i >= len(t.headers) || tarEntry(hdr) != t.headers[i] {
+			return fmt.Errorf("the archive changed while it was being extracted")
+		}
+		if err := fn(i, tr); err != nil {
+			return err
+		}
+		i++
+	}
+	if i != len(t.headers) {
+		return fmt.Errorf("the archive changed while it was being extracted")
+	}
+	return ts.finish()
+}
+
+//======================================================================
+
+// A tar is padded out after its last entry, but not by this much
+const maxTarTrailer = 1 << 20
+
+// tarStream is a tar file, decompressed as it's read.
+type tarStream struct {
+	io.Reader
+	wait    func() error // once it's all been read, did the decompressor finish happily?
+	stop    func()       // always called, when done with it
+	stopped bool
+}
+
+// finish reads what's left after the tar's last entry, which for gzip includes its checksum,
+// and says whether the decompressor was happy with it all.
+func (s *tarStream) finish() error {
+	n, err := io.CopyN(ioutil.Discard, s, maxTarTrailer+1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n > maxTarTrailer {
+		return fmt.Errorf("there's too much after the end of the archive")
+	}
+	return s.wait()
+}
+
+func (s *tarStream) Close() {
+	if !s.stopped {
+		s.stopped = true
+		s.stop()
+	}
+}
+
+// openTar reads the tar in r, decompressing it if it's compressed. Go has no zstd, so for
+// .tar.zst the zstd command has to be installed.
+func openTar(r io.Reader, format string) (*tarStream, error) {
+	switch format {
+	case "tar.gz":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return &tarStream{
+			Reader: zr,
+			wait:   func() error { return nil },
+			stop:   func() { zr.Close() },
+		}, nil
+
+	case "tar.zst":
+		cmd := exec.Command("zstd", "-d", "-c", "-q")
+		cmd.Stdin = r
+		out, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("zstd is needed to extract a .tar.zst: %v", err)
+		}
+		waited := false
+		return &tarStream{
+			Reader: out,
+			wait: func() error {
+				waited = true
+				if err := cmd.Wait(); err != nil {
+					return fmt.Errorf("zstd: %v", err)
+				}
+				return nil
+			},
+			stop: func() {
+				if !waited {
+					cmd.Process.Kill()
+					cmd.Wait()
+				}
+			},
+		}, nil
+
+	default:
+		return &tarStream{
+			Reader: r,
+			wait:   func() error { return nil },
+			stop:   func() {},
+		}, nil
+	}
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
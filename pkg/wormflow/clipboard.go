@@ -0,0 +1,104 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+//======================================================================
+
+// CopyMode determines where a received message goes when the user hits Copy.
+type CopyMode int
+
+const (
+	CopyBoth      CopyMode = iota // the tmux paste buffer and the system clipboard
+	CopyBuffer                    // just the tmux paste buffer, for prefix-]
+	CopyClipboard                 // just the system clipboard, via OSC 52
+)
+
+// ParseCopyMode converts the @wormhole-copy-to tmux option. Empty means both.
+func ParseCopyMode(s string) (CopyMode, error) {
+	switch s {
+	case "", "both":
+		return CopyBoth, nil
+	case "buffer":
+		return CopyBuffer, nil
+	case "clipboard":
+		return CopyClipboard, nil
+	default:
+		return CopyBoth, fmt.Errorf("unknown copy destination %q", s)
+	}
+}
+
+func (m CopyMode) copy(txt string) error {
+	if m != CopyClipboard {
+		if err := loadBuffer("", txt); err != nil {
+			return err
+		}
+	}
+	if m != CopyBuffer {
+		if err := copyToClipboard(txt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//======================================================================
+
+// loadBuffer loads txt into the tmux paste buffer called name or, if name is empty, a new one.
+// Like pasteBuffer, this is the user's own tmux server, so prefix-] pastes it.
+func loadBuffer(name string, txt string) error {
+	args := []string{"load-buffer"}
+	if name != "" {
+		args = append(args, "-b", name)
+	}
+	cmd := exec.Command("tmux", append(args, "-")...)
+	cmd.Stdin = strings.NewReader(txt)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("tmux load-buffer: %v %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// copyToClipboard asks the terminal to put txt on the system clipboard with an OSC 52 escape
+// sequence. The sequence is written straight to the tty of the tmux client, so it doesn't
+// depend on tmux's set-clipboard or allow-passthrough options - but the terminal has to
+// support it.
+func copyToClipboard(txt string) error {
+	out, err := exec.Command("tmux", "display-message", "-p", "#{client_tty}").Output()
+	if err != nil {
+		return fmt.Errorf("could not find the terminal: %v", err)
+	}
+	tty := strings.TrimSpace(string(out))
+	if tty == "" {
+		return fmt.Errorf("could not find the terminal")
+	}
+
+	f, err := os.OpenFile(tty, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(osc52(txt))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func osc52(txt string) string {
+	return "\x1b]52;c;" + base64.StdEncoding.EncodeToString([]byte(txt)) + "\a"
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
@@ -0,0 +1,144 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/gcla/gowid"
+	"github.com/gcla/gowid/widgets/dialog"
+)
+
+//======================================================================
+
+// What to do when the file or directory being received already exists
+type conflictChoice int
+
+const (
+	conflictOverwrite conflictChoice = iota
+	conflictRename
+	conflictBackup
+	conflictReject
+)
+
+// What happens to whatever is already at the name being saved to. Nothing is done to it until
+// what's received is complete - see saveDir.place.
+type replaceMode int
+
+const (
+	replaceNothing  replaceMode = iota // there's nothing there - and if something appears meanwhile, saving fails
+	replaceExisting                    // the user chose to overwrite it
+	replaceBackup                      // the user chose to rename it e.g. to foo.~1~
+)
+
+// resolveConflict is called from the receiving goroutine before anything is written. If name
+// exists in the save folder, the user is asked what to do - unless @wormhole-can-overwrite is
+// set, which means overwrite. It returns the name to save as, what to do with what's already
+// there, and false if the offer should be rejected.
+func (w *Controller) resolveConflict(d *saveDir, name string, app gowid.IApp) (string, replaceMode, bool, error) {
+	if !d.exists(name) {
+		return name, replaceNothing, true, nil
+	}
+
+	choice := conflictOverwrite
+	if !w.Args.Overwrite {
+		c := make(chan conflictChoice, 1)
+		app.Run(gowid.RunFunction(func(app gowid.IApp) {
+			w.doConflict(d.join(name), c, app)
+		}))
+
+		select {
+		case choice = <-c:
+		case <-w.ctx.Done():
+			return "", replaceNothing, false, w.ctx.Err()
+		}
+	}
+
+	switch choice {
+	case conflictOverwrite:
+		return name, replaceExisting, true, nil
+	case conflictRename:
+		return numberedName(d, name), replaceNothing, true, nil
+	case conflictBackup:
+		return name, replaceBackup, true, nil
+	default:
+		return "", replaceNothing, false, nil
+	}
+}
+
+func (w *Controller) doConflict(path string, c chan<- conflictChoice, app gowid.IApp) {
+	txt := fmt.Sprintf("%q exists.", path)
+
+	d := makeTxtDialog(txt,
+		dialog.Button{
+			Msg:    "Overwrite",
+			Action: &resolve{choice: conflictOverwrite, c: c, Controller: w},
+		},
+		dialog.Button{
+			Msg:    "Rename",
+			Action: &resolve{choice: conflictRename, c: c, Controller: w},
+		},
+		dialog.Button{
+			Msg:    "Backup",
+			Action: &resolve{choice: conflictBackup, c: c, Controller: w},
+		},
+		dialog.Button{
+			Msg:    "Reject",
+			Action: &resolve{choice: conflictReject, c: c, Controller: w},
+		},
+	)
+
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: len(txt) + 10}, gowid.RenderFlow{}, app)
+}
+
+type resolve struct {
+	common
+	choice conflictChoice
+	c      chan<- conflictChoice
+	*Controller
+}
+
+// Destination exists - hit one of the buttons
+func (w resolve) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface{}) {
+	w.previous.Close(app)
+	w.c <- w.choice
+}
+
+//======================================================================
+
+// numberedName returns the first of "name (1).ext", "name (2).ext" and so on that doesn't
+// exist in d.
+func numberedName(d *saveDir, name string) string {
+	ext := filepath.Ext(name)
+	if d.isDir(name) {
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		res := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if !d.exists(res) {
+			return res
+		}
+	}
+}
+
+// backupName returns the first of "name.~1~", "name.~2~" and so on that doesn't exist in d,
+// like cp --backup=numbered.
+func backupName(d *saveDir, name string) string {
+	for i := 1; ; i++ {
+		res := fmt.Sprintf("%s.~%d~", name, i)
+		if !d.exists(res) {
+			return res
+		}
+	}
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
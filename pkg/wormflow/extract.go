@@ -0,0 +1,425 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+//======================================================================
+
+// Symlink targets longer than this aren't believable
+const maxLinkTarget = 4096
+
+// archiveEntry is what extraction needs to know about each thing in an archive, before any of
+// it is read.
+type archiveEntry struct {
+	name    string
+	mode    os.FileMode
+	modTime time.Time
+	size    uint64 // uncompressed
+	link    string // symlink target, if the format keeps it in the header rather than the content
+}
+
+// archive is something extractArchive can unpack - a zip, or a tar.
+type archive interface {
+	// entries lists everything in the archive, in order
+	entries() []archiveEntry
+	// each calls fn with the content of every entry, in the same order
+	each(fn func(i int, r io.Reader) error) error
+}
+
+// extractZip unpacks zr into dir in the save folder d - see extractArchive.
+func extractZip(ctx context.Context, zr *zip.Reader, d *saveDir, dir string, ep *extractProgress) error {
+	return extractArchive(ctx, zipArchive{zr}, d, dir, ep)
+}
+
+// extractArchive unpacks a into dir, which must already exist in the save folder d.
+// Directories, permissions, modification times and symlinks are recreated from the headers.
+// Every name is checked before anything is written, and everything is created through d, so
+// nothing is written through a symlink. Symlinks are created last, and only if their target
+// stays inside dir. ep is kept up to date as it goes.
+func extractArchive(ctx context.Context, a archive, d *saveDir, dir string, ep *extractProgress) error {
+	// Set once everything is written, deepest first, in case a directory isn't writable
+	type dirAttrs struct {
+		name    string
+		mode    os.FileMode
+		modTime time.Time
+	}
+	var dirs []dirAttrs
+
+	// Names are checked against where dir is in the save folder. Nothing is looked up by this
+	// path - d does that - so it doesn't matter if the save folder is really somewhere else.
+	root := d.join(dir)
+
+	entries := a.entries()
+	paths := make([]string, len(entries))
+	links := make(map[string]bool)
+	var err error
+	for i, e := range entries {
+		// A tar made with tar -C foo . starts with ./ - that's dir itself
+		if e.mode.IsDir() && path.Clean(e.name) == "." {
+			paths[i] = root
+			continue
+		}
+		if paths[i], err = entryPath(root, e.name); err != nil {
+			return err
+		}
+		if e.mode&os.ModeSymlink != 0 {
+			links[paths[i]] = true
+		}
+	}
+	for i, e := range entries {
+		if paths[i] == root {
+			continue
+		}
+		for p := filepath.Dir(paths[i]); p != root; p = filepath.Dir(p) {
+			if links[p] {
+				return fmt.Errorf("%q would be written through the symlink %q", e.name, p)
+			}
+		}
+	}
+
+	ep.start(entries)
+
+	// Symlink targets, by entry - they're created once everything else is there
+	targets := make(map[int]string)
+
+	err = a.each(func(i int, r io.Reader) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		e := entries[i]
+		name := d.rel(paths[i])
+
+		switch {
+		case e.mode.IsDir():
+			if err := d.mkdirAll(name); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirAttrs{name: name, mode: e.mode, modTime: e.modTime})
+
+		case e.mode&os.ModeSymlink != 0:
+			target, err := linkTarget(e, r)
+			if err != nil {
+				return err
+			}
+			targets[i] = target
+
+		case e.mode.IsRegular():
+			ep.next(e.name)
+			if err := extractFile(e, r, d, name, ep); err != nil {
+				return err
+			}
+
+		case e.mode&os.ModeIrregular != 0:
+			return fmt.Errorf("%q: hard links and empty symlinks aren't supported", e.name)
+
+		default:
+			return fmt.Errorf("%q: unsupported file type %v", e.name, e.mode.Type())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, e := range entries {
+		if e.mode&os.ModeSymlink == 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ep.next(e.name)
+		if err := checkLinkTarget(root, paths[i], targets[i], links); err != nil {
+			return fmt.Errorf("symlink %q: %v", e.name, err)
+		}
+		name := d.rel(paths[i])
+		if err := d.mkdirAll(filepath.Dir(name)); err != nil {
+			return err
+		}
+		if err := d.symlink(targets[i], name); err != nil {
+			return err
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		f, err := d.openDir(dirs[i].name)
+		if err != nil {
+			return err
+		}
+		// Whatever the archive says, the owner can always get in, and remove it again
+		mode := dirs[i].mode
+		if mode.Perm() != 0 {
+			mode |= 0700
+		}
+		err = setAttrs(f, mode, dirs[i].modTime)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractFile writes the regular file e, from r, to name in the save folder d.
+func extractFile(e archiveEntry, r io.Reader, d *saveDir, name string, ep *extractProgress) error {
+	if err := d.mkdirAll(filepath.Dir(name)); err != nil {
+		return err
+	}
+
+	// The directory is new, so anything already at name - a symlink, or a duplicate entry - is
+	// an attack
+	f, err := d.create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, &extractReader{ep: ep, Reader: r})
+	if err == nil {
+		err = setAttrs(f, e.mode, e.modTime)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// linkTarget returns where the symlink e points. A zip keeps that as the entry's content.
+func linkTarget(e archiveEntry, r io.Reader) (string, error) {
+	target := []byte(e.link)
+	if e.link == "" {
+		var err error
+		if target, err = ioutil.ReadAll(io.LimitReader(r, maxLinkTarget+1)); err != nil {
+			return "", err
+		}
+	}
+	if len(target) == 0 || len(target) > maxLinkTarget {
+		return "", fmt.Errorf("symlink %q has an invalid target", e.name)
+	}
+	return string(target), nil
+}
+
+//======================================================================
+
+// zipArchive is a zip, for extractArchive. Symlink targets are the content of their entries.
+type zipArchive struct {
+	*zip.Reader
+}
+
+func (z zipArchive) entries() []archiveEntry {
+	res := make([]archiveEntry, 0, len(z.File))
+	for _, zf := range z.File {
+		res = append(res, archiveEntry{
+			name:    zf.Name,
+			mode:    zf.Mode(),
+			modTime: zf.Modified,
+			size:    zf.UncompressedSize64,
+		})
+	}
+	return res
+}
+
+func (z zipArchive) each(fn func(i int, r io.Reader) error) error {
+	for i, zf := range z.File {
+		// Nothing to read from a directory
+		if zf.Mode().IsDir() {
+			if err := fn(i, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return fmt.Errorf("%q open failed: %v", zf.Name, err)
+		}
+		err = fn(i, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//======================================================================
+
+// extractProgress is updated by extractZip as it goes, and read by the ticker that updates the
+// progress bar. Directories aren't counted - they're quick, and there's nothing in them.
+type extractProgress struct {
+	mu sync.Mutex
+	extractState
+}
+
+type extractState struct {
+	started    bool
+	files      int // regular files and symlinks
+	totalFiles int
+	bytes      int64
+	totalBytes int64
+	name       string // the one being extracted
+}
+
+func (ep *extractProgress) start(entries []archiveEntry) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	for _, e := range entries {
+		if !e.mode.IsDir() {
+			ep.totalFiles++
+			ep.totalBytes += int64(e.size)
+		}
+	}
+	ep.started = true
+}
+
+func (ep *extractProgress) next(name string) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.files++
+	ep.name = name
+}
+
+func (ep *extractProgress) add(n int) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.bytes += int64(n)
+}
+
+func (ep *extractProgress) get() extractState {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return ep.extractState
+}
+
+// describe is for the progress dialog e.g.
+//
+//	Extracting 3/10 files
+//	foo/bar.txt
+//	1.2 MB of 4.0 MB
+func (s extractState) describe() string {
+	return fmt.Sprintf("Extracting %d/%d files\n%s\n%s of %s", s.files, s.totalFiles,
+		shortName(s.name, progNameWidth), humanBytes(s.bytes), humanBytes(s.totalBytes))
+}
+
+type extractReader struct {
+	ep *extractProgress
+	io.Reader
+}
+
+func (r *extractReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	r.ep.add(n)
+	return
+}
+
+//======================================================================
+
+// entryPath returns where the zip entry called name should be extracted to under dir, which
+// must be absolute and clean. Names are refused if they're absolute, contain a .. component
+// or a control character, or would otherwise end up outside dir. Backslashes count as separators here, so a name
+// like ..\..\foo made on Windows is refused too.
+func entryPath(dir string, name string) (string, error) {
+	bad := fmt.Errorf("dangerous filename found: %q", name)
+
+	if name == "" || strings.IndexFunc(name, unicode.IsControl) != -1 {
+		return "", bad
+	}
+	if name[0] == '/' || name[0] == '\\' || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", bad
+	}
+	// A drive letter e.g. C:foo - VolumeName only spots these on Windows
+	if len(name) >= 2 && name[1] == ':' {
+		return "", bad
+	}
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return "", bad
+		}
+	}
+
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	if p == dir || !within(dir, p) {
+		return "", bad
+	}
+	return p, nil
+}
+
+// within returns true if p is dir or something below it. Both must be absolute and clean.
+// Unlike a plain prefix check, /tmp/foo-evil is not within /tmp/foo.
+func within(dir string, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// checkLinkTarget follows target from the directory holding the link at p, one component at
+// a time as the kernel would. A lexical check isn't enough - if a/l links to .. then a/l/..
+// is dir's parent, not a. So the walk must stay within dir, and may not pass through another
+// of the archive's links, whose targets aren't known to be safe from here.
+func checkLinkTarget(dir string, p string, target string, links map[string]bool) error {
+	if filepath.IsAbs(target) || strings.ContainsRune(target, '\\') || strings.ContainsRune(target, 0) {
+		return fmt.Errorf("invalid target %q", target)
+	}
+
+	cur := filepath.Dir(p)
+	for _, part := range strings.Split(target, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		// Only the last component may be a link - any other would have to be followed
+		if links[cur] {
+			return fmt.Errorf("target %q goes through another symlink", target)
+		}
+		if part == ".." {
+			cur = filepath.Dir(cur)
+		} else {
+			cur = filepath.Join(cur, part)
+		}
+		if !within(dir, cur) {
+			return fmt.Errorf("target %q points outside the directory", target)
+		}
+	}
+	return nil
+}
+
+// setAttrs applies the permission bits and modification time from a zip header to f. Archives
+// made without unix permissions report 0, in which case the defaults are left alone. setuid
+// and friends are never applied, and nor is write permission for anyone else - the save folder
+// may be on a shared machine.
+func setAttrs(f *os.File, mode os.FileMode, modTime time.Time) error {
+	if mode.Perm() != 0 {
+		if err := f.Chmod(mode.Perm() &^ 0022); err != nil {
+			return err
+		}
+	}
+	if !modTime.IsZero() {
+		if err := setTimes(f, modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
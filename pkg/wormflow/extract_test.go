@@ -0,0 +1,616 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+//======================================================================
+
+type zipEntry struct {
+	name string
+	body string // a symlink's target
+	mode os.FileMode
+}
+
+func zipFile(name string) zipEntry {
+	return zipEntry{name: name, body: "content of " + name, mode: 0644}
+}
+
+func zipDir(name string) zipEntry {
+	return zipEntry{name: name, mode: os.ModeDir | 0755}
+}
+
+func zipLink(name string, target string) zipEntry {
+	return zipEntry{name: name, body: target, mode: os.ModeSymlink | 0777}
+}
+
+func makeZip(t *testing.T, entries []zipEntry) *zip.Reader {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		hdr.SetMode(e.mode)
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zr
+}
+
+// tarItem is a tar header, and the content if it's a regular file
+type tarItem struct {
+	hdr  tar.Header
+	body string
+}
+
+func tarFile(name string) tarItem {
+	return tarItem{hdr: tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}, body: "content of " + name}
+}
+
+func tarDir(name string) tarItem {
+	return tarItem{hdr: tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}}
+}
+
+func tarLink(name string, target string) tarItem {
+	return tarItem{hdr: tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target, Mode: 0777}}
+}
+
+func tarHardLink(name string, target string) tarItem {
+	return tarItem{hdr: tar.Header{Name: name, Typeflag: tar.TypeLink, Linkname: target, Mode: 0644}}
+}
+
+func makeTar(t *testing.T, items []tarItem, gz bool) []byte {
+	var buf bytes.Buffer
+	var tw *tar.Writer
+	var zw *gzip.Writer
+	if gz {
+		zw = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(zw)
+	} else {
+		tw = tar.NewWriter(&buf)
+	}
+	for _, it := range items {
+		hdr := it.hdr
+		hdr.Size = int64(len(it.body))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(it.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// listDir returns the names in dir, and below it, sorted
+func listDir(t *testing.T, dir string) []string {
+	var res []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != dir {
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			res = append(res, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// listTree returns everything below root, except what's below skip, with the content of each
+// file, so it can be checked that nothing outside skip changed.
+func listTree(t *testing.T, root string, skip string) []string {
+	var res []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == skip {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		entry := p + " " + info.Mode().String()
+		if info.Mode().IsRegular() {
+			b, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			entry += " " + string(b)
+		}
+		res = append(res, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(res)
+	return res
+}
+
+//======================================================================
+
+func TestExtractZip(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []zipEntry
+		setup   func(t *testing.T, out string, outside string) // before extracting
+		fail    bool
+		msg     string   // in the error, if it's the same everywhere
+		want    []string // what's in out afterwards
+	}{
+		{
+			name:    "valid",
+			entries: []zipEntry{zipDir("d/"), zipFile("d/a.txt"), zipFile("b.txt"), zipLink("d/l", "a.txt"), zipLink("up", "d/../b.txt")},
+			want:    []string{"b.txt", "d", "d/a.txt", "d/l", "up"},
+		},
+		{
+			name:    "sibling",
+			entries: []zipEntry{zipFile("../out-evil/x")},
+			fail:    true,
+			msg:     "dangerous filename",
+		},
+		{
+			name:    "dotdot",
+			entries: []zipEntry{zipFile("../x")},
+			fail:    true,
+			msg:     "dangerous filename",
+		},
+		{
+			name:    "backslashes",
+			entries: []zipEntry{zipFile(`..\..\x`)},
+			fail:    true,
+			msg:     "dangerous filename",
+		},
+		{
+			name:    "absolute",
+			entries: []zipEntry{zipFile("/abs")},
+			fail:    true,
+			msg:     "dangerous filename",
+		},
+		{
+			name:    "drive letter",
+			entries: []zipEntry{zipFile("C:foo")},
+			fail:    true,
+			msg:     "dangerous filename",
+		},
+		{
+			name:    "NUL",
+			entries: []zipEntry{zipFile("a\x00b")},
+			fail:    true,
+			msg:     "dangerous filename",
+		},
+		{
+			name:    "newline",
+			entries: []zipEntry{zipFile("a.txt\nb.txt")},
+			fail:    true,
+			msg:     "dangerous filename",
+		},
+		{
+			name:    "duplicate",
+			entries: []zipEntry{zipFile("a.txt"), zipFile("a.txt")},
+			fail:    true,
+		},
+		{
+			name:    "through a symlink entry",
+			entries: []zipEntry{zipLink("l", "."), zipFile("l/x")},
+			fail:    true,
+			msg:     "would be written through the symlink",
+		},
+		{
+			name:    "link escapes through another link",
+			entries: []zipEntry{zipDir("a/"), zipLink("a/l", ".."), zipLink("b", "a/l/../outside/x")},
+			fail:    true,
+			msg:     "goes through another symlink",
+		},
+		{
+			name:    "absolute link",
+			entries: []zipEntry{zipLink("l", "/etc/passwd")},
+			fail:    true,
+			msg:     "invalid target",
+		},
+		{
+			name:    "link out",
+			entries: []zipEntry{zipLink("l", "../outside/x")},
+			fail:    true,
+			msg:     "points outside",
+		},
+		{
+			name:    "symlink already at a file",
+			entries: []zipEntry{zipFile("a.txt")},
+			setup: func(t *testing.T, out string, outside string) {
+				if err := os.Symlink(filepath.Join(outside, "x"), filepath.Join(out, "a.txt")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			fail: true,
+		},
+		{
+			name:    "symlink already at a directory",
+			entries: []zipEntry{zipDir("d/"), zipFile("d/x")},
+			setup: func(t *testing.T, out string, outside string) {
+				if err := os.Symlink(outside, filepath.Join(out, "d")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			fail: true,
+		},
+		{
+			name:    "symlink already at a symlink",
+			entries: []zipEntry{zipLink("l", "a.txt")},
+			setup: func(t *testing.T, out string, outside string) {
+				if err := os.Symlink(outside, filepath.Join(out, "l")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			fail: true,
+		},
+		{
+			name:    "the directory is a symlink",
+			entries: []zipEntry{zipFile("x")},
+			setup: func(t *testing.T, out string, outside string) {
+				if err := os.Remove(out); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(outside, out); err != nil {
+					t.Fatal(err)
+				}
+			},
+			fail: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			parent, err := ioutil.TempDir("", "wormflow")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(parent)
+
+			save := filepath.Join(parent, "save")
+			out := filepath.Join(save, "out")
+			outside := filepath.Join(parent, "outside")
+			for _, d := range []string{save, out, outside} {
+				if err := os.Mkdir(d, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ioutil.WriteFile(filepath.Join(outside, "x"), []byte("precious"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if test.setup != nil {
+				test.setup(t, out, outside)
+			}
+			before := listTree(t, parent, out)
+
+			sd, err := openSaveDir(save)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sd.Close()
+
+			err = extractZip(context.Background(), makeZip(t, test.entries), sd, "out", &extractProgress{})
+			switch {
+			case !test.fail && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case test.fail && err == nil:
+				t.Errorf("expected an error")
+			case test.fail && !strings.Contains(err.Error(), test.msg):
+				t.Errorf("expected an error containing %q, got %v", test.msg, err)
+			}
+
+			if after := listTree(t, parent, out); strings.Join(after, "\n") != strings.Join(before, "\n") {
+				t.Errorf("something changed outside the directory:\nbefore:\n%s\nafter:\n%s",
+					strings.Join(before, "\n"), strings.Join(after, "\n"))
+			}
+
+			if test.want != nil {
+				if got := listDir(t, out); strings.Join(got, " ") != strings.Join(test.want, " ") {
+					t.Errorf("extracted %v, expected %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+//======================================================================
+
+// TestExtractReceived extracts tars, as received files, next to them
+func TestExtractReceived(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string // the archive received
+		items []tarItem
+		fail  bool
+		msg   string   // in the error, if it's the same everywhere
+		want  []string // what it's extracted to
+	}{
+		{
+			name:  "tar",
+			file:  "t.tar",
+			items: []tarItem{tarDir("d/"), tarFile("d/a.txt"), tarLink("l", "d/a.txt")},
+			want:  []string{"d", "d/a.txt", "l"},
+		},
+		{
+			name:  "tar.gz",
+			file:  "t.tar.gz",
+			items: []tarItem{tarDir("d/"), tarFile("d/a.txt"), tarLink("d/l", "../b.txt"), tarFile("b.txt")},
+			want:  []string{"b.txt", "d", "d/a.txt", "d/l"},
+		},
+		{
+			name:  "root entry",
+			file:  "t.tgz",
+			items: []tarItem{tarDir("./"), tarDir("./d/"), tarFile("./d/a.txt")},
+			want:  []string{"d", "d/a.txt"},
+		},
+		{
+			name:  "hard link",
+			file:  "t.tar",
+			items: []tarItem{tarFile("a.txt"), tarHardLink("b.txt", "/etc/passwd")},
+			fail:  true,
+			msg:   "hard links",
+		},
+		{
+			name:  "empty symlink",
+			file:  "t.tar",
+			items: []tarItem{tarLink("l", "")},
+			fail:  true,
+			msg:   "invalid target",
+		},
+		{
+			name:  "dotdot",
+			file:  "t.tar.gz",
+			items: []tarItem{tarFile("../../outside/x")},
+			fail:  true,
+			msg:   "dangerous filename",
+		},
+		{
+			name:  "link out",
+			file:  "t.tar",
+			items: []tarItem{tarLink("l", "../../outside/x")},
+			fail:  true,
+			msg:   "points outside",
+		},
+		{
+			name:  "through a symlink entry",
+			file:  "t.tar",
+			items: []tarItem{tarLink("l", "."), tarFile("l/x")},
+			fail:  true,
+			msg:   "would be written through the symlink",
+		},
+		{
+			name:  "link escapes through another link",
+			file:  "t.tar.gz",
+			items: []tarItem{tarDir("a/"), tarLink("a/l", ".."), tarLink("b", "a/l/../../outside/x")},
+			fail:  true,
+			msg:   "goes through another symlink",
+		},
+		{
+			name:  "duplicate",
+			file:  "t.tar",
+			items: []tarItem{tarFile("a.txt"), tarFile("a.txt")},
+			fail:  true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			parent, err := ioutil.TempDir("", "wormflow")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(parent)
+
+			save := filepath.Join(parent, "save")
+			outside := filepath.Join(parent, "outside")
+			for _, d := range []string{save, outside} {
+				if err := os.Mkdir(d, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ioutil.WriteFile(filepath.Join(outside, "x"), []byte("precious"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			gz := !strings.HasSuffix(test.file, ".tar")
+			if err := ioutil.WriteFile(filepath.Join(save, test.file), makeTar(t, test.items, gz), 0644); err != nil {
+				t.Fatal(err)
+			}
+			before := listTree(t, outside, "")
+
+			sd, err := openSaveDir(save)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sd.Close()
+
+			dir, err := extractReceived(context.Background(), sd, test.file, Limits{}, &extractProgress{})
+			switch {
+			case !test.fail && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case test.fail && err == nil:
+				t.Errorf("expected an error")
+			case test.fail && !strings.Contains(err.Error(), test.msg):
+				t.Errorf("expected an error containing %q, got %v", test.msg, err)
+			}
+
+			if after := listTree(t, outside, ""); strings.Join(after, "\n") != strings.Join(before, "\n") {
+				t.Errorf("something changed outside the save folder:\nbefore:\n%s\nafter:\n%s",
+					strings.Join(before, "\n"), strings.Join(after, "\n"))
+			}
+
+			// Nothing's left behind if it fails, not even the hidden directory it was extracted into
+			names, err := ioutil.ReadDir(save)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, n := range names {
+				got = append(got, n.Name())
+			}
+			want := []string{test.file}
+			if !test.fail {
+				want = []string{"t", test.file}
+			}
+			if strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("the save folder has %v, expected %v", got, want)
+			}
+
+			if test.want != nil {
+				if dir != filepath.Join(save, "t") {
+					t.Errorf("extracted to %s, expected %s", dir, filepath.Join(save, "t"))
+				}
+				if got := listDir(t, filepath.Join(save, "t")); strings.Join(got, " ") != strings.Join(test.want, " ") {
+					t.Errorf("extracted %v, expected %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+// TestRemoveReadOnly makes sure directories that aren't writable, extracted or not, can still be
+// removed - otherwise a hidden half-extracted tree could be left behind
+func TestRemoveReadOnly(t *testing.T) {
+	save, err := ioutil.TempDir("", "wormflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(save)
+	sd, err := openSaveDir(save)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+
+	if err := sd.mkdir("out"); err != nil {
+		t.Fatal(err)
+	}
+	zr := makeZip(t, []zipEntry{
+		{name: "ro/", mode: os.ModeDir | 0555},
+		zipFile("ro/a.txt"),
+		{name: "wo/", mode: os.ModeDir | 0200},
+		zipFile("wo/b.txt"),
+	})
+	if err := extractZip(context.Background(), zr, sd, "out", &extractProgress{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"ro", "wo"} {
+		info, err := os.Lstat(filepath.Join(save, "out", dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm()&0700 != 0700 {
+			t.Errorf("%s was extracted as %v", dir, info.Mode())
+		}
+	}
+	if err := sd.discard("out", nil); err != nil {
+		t.Errorf("couldn't remove what was extracted: %v", err)
+	}
+
+	// Made read-only by the user, not extracted
+	own := filepath.Join(save, "own", "sub")
+	if err := os.MkdirAll(own, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(own, "c.txt"), nil, 0444); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{own, filepath.Dir(own)} {
+		if err := os.Chmod(dir, 0555); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sd.removeAll("own"); err != nil {
+		t.Errorf("couldn't remove a read-only directory: %v", err)
+	}
+	if names := listDir(t, save); len(names) != 0 {
+		t.Errorf("left behind: %v", names)
+	}
+}
+
+// TestTarChanged makes sure what's extracted from a tar is what was checked, though it's read twice
+func TestTarChanged(t *testing.T) {
+	versions := [][]byte{
+		makeTar(t, []tarItem{tarFile("a.txt")}, false),
+		makeTar(t, []tarItem{tarLink("a.txt", "../../outside/x")}, false),
+	}
+	opened := 0
+	open := func() (*tarStream, error) {
+		b := versions[opened]
+		opened++
+		return openTar(bytes.NewReader(b), "tar")
+	}
+	ta, err := newTarArchive(open, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	save, err := ioutil.TempDir("", "wormflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(save)
+	sd, err := openSaveDir(save)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+	if err := sd.mkdir("out"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = extractArchive(context.Background(), ta, sd, "out", &extractProgress{})
+	if err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Errorf("expected the change to be spotted, got %v", err)
+	}
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
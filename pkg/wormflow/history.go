@@ -0,0 +1,379 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gcla/gowid"
+	"github.com/gcla/gowid/gwutil"
+	"github.com/gcla/gowid/widgets/button"
+	"github.com/gcla/gowid/widgets/dialog"
+	"github.com/gcla/gowid/widgets/divider"
+	"github.com/gcla/gowid/widgets/list"
+	"github.com/gcla/gowid/widgets/pile"
+	"github.com/gcla/gowid/widgets/styled"
+	"github.com/gcla/gowid/widgets/text"
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+//======================================================================
+
+// How a transfer ended
+const (
+	outcomeSaved     = "saved"    // a file or directory was received
+	outcomeReceived  = "received" // a message was received
+	outcomeSent      = "sent"
+	outcomeRejected  = "rejected"
+	outcomeCancelled = "cancelled"
+	outcomeFailed    = "failed"
+)
+
+// historyEntry is one line of the history file, which is JSON lines, appended to after every
+// transfer.
+type historyEntry struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"` // receive or send
+	Nameplate string    `json:"nameplate"` // just the number - the rest of the code is a secret
+	Type      string    `json:"type,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	Path      string    `json:"path,omitempty"`      // where it was saved, or sent from
+	Extracted bool      `json:"extracted,omitempty"` // Path is what an archive was extracted to - it's gone
+	Duration  float64   `json:"duration"`            // seconds
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// nameplate returns the number at the start of a wormhole code
+func nameplate(code string) string {
+	return strings.SplitN(code, "-", 2)[0]
+}
+
+// startRecord begins the history entry for a transfer. It's written by finishRecord.
+func (w *Controller) startRecord(e historyEntry) {
+	e.Time = time.Now()
+	w.record = &e
+}
+
+// finishRecord writes the history entry for the transfer in progress, if there is one and it
+// hasn't already been written. It's called from every dialog a transfer can end on.
+func (w *Controller) finishRecord(outcome string, path string, err error) {
+	if w.record == nil {
+		return
+	}
+	e := *w.record
+	w.record = nil
+
+	e.Duration = time.Since(e.Time).Round(time.Millisecond).Seconds()
+	e.Outcome = outcome
+	if path != "" {
+		e.Path = path
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	// Not worth bothering the user about - the transfer itself is what matters
+	appendHistory(w.Args.History, e)
+}
+
+func appendHistory(path string, e historyEntry) error {
+	if path == "" {
+		return nil
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	// One write, so lines from two tmux-wormholes at once don't get mixed up
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readHistory returns every entry in the history file, oldest first. Lines that can't be
+// parsed are skipped, and a missing file is no history.
+func readHistory(path string) ([]historyEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := make([]historyEntry, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e historyEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			res = append(res, e)
+		}
+	}
+	return res, scanner.Err()
+}
+
+// summary describes the entry in one line for the history browser
+func (e historyEntry) summary() string {
+	res := fmt.Sprintf("%s  %-7s %-9s %q", e.Time.Local().Format("2006-01-02 15:04"), e.Direction, e.Type, e.Name)
+	if e.Size > 0 {
+		res += fmt.Sprintf(" (%s)", humanBytes(e.Size))
+	}
+	return res + " - " + e.Outcome
+}
+
+//======================================================================
+
+// How many past transfers the history browser lists
+const maxHistory = 500
+
+// doHistory lists past transfers, newest first. Choosing one shows the details, and what can
+// be done with whatever was received.
+func (w *Controller) doHistory(app gowid.IApp) {
+	entries, err := readHistory(w.Args.History)
+	if err != nil {
+		w.doError(err, app)
+		return
+	}
+	if len(entries) == 0 {
+		w.doMessageThenQuit("No transfers yet.", "Quit", app)
+		return
+	}
+
+	var d *dialog.Widget
+
+	txt := fmt.Sprintf("Past transfers, from %s", w.Args.History)
+	wid := len(txt)
+	rows := make([]gowid.IWidget, 0, gwutil.Min(len(entries), maxHistory))
+
+	for i := len(entries) - 1; i >= 0 && len(rows) < maxHistory; i-- {
+		e := entries[i]
+		label := e.summary()
+		btn := button.NewBare(text.New(label))
+		btn.OnClick(gowid.WidgetCallback{
+			Name: "cb",
+			WidgetChangedFunction: func(app gowid.IApp, _ gowid.IWidget) {
+				d.Close(app)
+				w.doHistoryEntry(e, app)
+			},
+		})
+		rows = append(rows, styled.NewExt(btn, gowid.MakePaletteRef("dialog"), gowid.MakePaletteRef("button-focus")))
+		wid = gwutil.Max(wid, len(label))
+	}
+
+	cols, _ := paneSize()
+	wid = gwutil.Min(wid, cols-viewerExtraCols)
+
+	view := pile.NewFlow(
+		text.New(txt),
+		divider.NewBlank(),
+		&gowid.ContainerWidget{
+			IWidget: list.New(list.NewSimpleListWalker(rows)),
+			D:       gowid.RenderWithUnits{U: gwutil.Min(maxBrowserRows, len(rows))},
+		},
+	)
+
+	d = makeInputDialog(view,
+		gowid.RenderFlow{},
+		dialog.Button{
+			Msg:    "Quit",
+			Action: &quit{Controller: w},
+		},
+	)
+
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: wid + 10}, gowid.RenderFlow{}, app)
+}
+
+func (w *Controller) doHistoryEntry(e historyEntry, app gowid.IApp) {
+	lines := []string{
+		fmt.Sprintf("%s %s %q", strings.Title(e.Direction), e.Type, e.Name),
+		fmt.Sprintf("When: %s, taking %s", e.Time.Local().Format("2006-01-02 15:04:05"),
+			time.Duration(e.Duration*float64(time.Second)).Round(time.Millisecond)),
+		fmt.Sprintf("Nameplate: %s", e.Nameplate),
+	}
+	if e.Size > 0 {
+		lines = append(lines, fmt.Sprintf("Size: %s", humanBytes(e.Size)))
+	}
+	lines = append(lines, fmt.Sprintf("Outcome: %s", e.Outcome))
+	if e.Error != "" {
+		lines = append(lines, fmt.Sprintf("Error: %s", e.Error))
+	}
+
+	// Only what was received can be opened or deleted from here, and only if it's still there
+	received := e.Direction == "receive" && e.Outcome == outcomeSaved && e.Path != ""
+	if received {
+		if _, err := os.Lstat(e.Path); err != nil {
+			received = false
+			lines = append(lines, fmt.Sprintf("Saved as: %q (no longer there)", e.Path))
+		} else {
+			lines = append(lines, fmt.Sprintf("Saved as: %q", e.Path))
+		}
+	} else if e.Path != "" {
+		lines = append(lines, fmt.Sprintf("Path: %q", e.Path))
+	}
+
+	buttons := make([]dialog.Button, 0, 5)
+	if received && w.Args.OpenCmd != "" {
+		buttons = append(buttons,
+			dialog.Button{
+				Msg:    "Open",
+				Action: &historyOpen{path: e.Path, Controller: w},
+			},
+			dialog.Button{
+				Msg:    "Reveal",
+				Action: &historyOpen{path: filepath.Dir(e.Path), Controller: w},
+			},
+		)
+	}
+	if received {
+		buttons = append(buttons, dialog.Button{
+			Msg:    "Delete",
+			Action: &historyDelete{entry: e, Controller: w},
+		})
+	}
+	buttons = append(buttons,
+		dialog.Button{
+			Msg:    "Back",
+			Action: &historyBack{Controller: w},
+		},
+		dialog.Button{
+			Msg:    "Quit",
+			Action: &quit{Controller: w},
+		},
+	)
+
+	txt := strings.Join(lines, "\n")
+	wid := 0
+	for _, line := range lines {
+		wid = gwutil.Max(wid, len(line))
+	}
+
+	d := makeTxtDialog(txt, buttons...)
+
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: wid + 10}, gowid.RenderFlow{}, app)
+}
+
+func (w *Controller) doHistoryError(err error, app gowid.IApp) {
+	txt := fmt.Sprintf("Error: %v", err)
+	d := makeTxtDialog(txt,
+		dialog.Button{
+			Msg:    "Continue",
+			Action: &historyBack{Controller: w},
+		},
+	)
+
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: len(txt) + 10}, gowid.RenderFlow{}, app)
+}
+
+//======================================================================
+
+type historyBack struct {
+	common
+	*Controller
+}
+
+// Looking at a past transfer - hit Back to see them all again
+func (w historyBack) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface{}) {
+	w.previous.Close(app)
+	w.doHistory(app)
+}
+
+//======================================================================
+
+type historyOpen struct {
+	common
+	path string
+	*Controller
+}
+
+// Looking at a past transfer - hit Open or Reveal. Reveal opens the folder it was saved to.
+func (w historyOpen) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface{}) {
+	w.previous.Close(app)
+	if shellCmd, err := w.runOpenCmd(w.path); err != nil {
+		w.doHistoryError(fmt.Errorf("%s: %v", shellCmd, err), app)
+		return
+	}
+	app.Quit()
+}
+
+//======================================================================
+
+type historyDelete struct {
+	common
+	entry     historyEntry
+	confirmed bool
+	*Controller
+}
+
+// Looking at a past transfer - hit Delete, then Delete again to confirm. The history itself
+// is left alone.
+func (w historyDelete) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface{}) {
+	w.previous.Close(app)
+	if !w.confirmed {
+		w.doConfirmDelete(w.entry, app)
+		return
+	}
+	if err := w.entry.deleteSaved(); err != nil {
+		w.doHistoryError(err, app)
+		return
+	}
+	w.doHistory(app)
+}
+
+// deleteSaved removes what was received, if it's still there. The path comes from the history
+// file, and may since have been reused - so it's only removed if it's still the same kind of
+// thing, and only a directory is removed with everything in it.
+func (e historyEntry) deleteSaved() error {
+	info, err := os.Lstat(e.Path)
+	if err != nil {
+		return err
+	}
+	dir := e.Type == Transfer(wormhole.TransferDirectory).String() || e.Extracted
+	switch {
+	case dir && info.IsDir():
+		return os.RemoveAll(e.Path)
+	case !dir && info.Mode().IsRegular():
+		return os.Remove(e.Path)
+	default:
+		return fmt.Errorf("%q isn't what was received any more, so it wasn't deleted", e.Path)
+	}
+}
+
+func (w *Controller) doConfirmDelete(e historyEntry, app gowid.IApp) {
+	txt := fmt.Sprintf("Delete %q?", e.Path)
+	d := makeTxtDialog(txt,
+		dialog.Button{
+			Msg:    "Delete",
+			Action: &historyDelete{entry: e, confirmed: true, Controller: w},
+		},
+		dialog.Button{
+			Msg:    "Back",
+			Action: &historyBack{Controller: w},
+		},
+	)
+
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: len(txt) + 10}, gowid.RenderFlow{}, app)
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
@@ -0,0 +1,240 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gcla/gowid"
+	"github.com/gcla/gowid/gwutil"
+	"github.com/gcla/gowid/widgets/dialog"
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+//======================================================================
+
+// Hooks are shell commands run once something is received, one for each type. Empty means
+// there's no hook for that type.
+type Hooks struct {
+	File      string
+	Directory string
+	Text      string
+}
+
+// How much of a hook's output is shown - the end of it, which is where errors usually are
+const (
+	maxHookLines  = 15
+	maxHookOutput = 64 * 1024
+)
+
+// hookEvent describes what was received, for the hook's environment
+type hookEvent struct {
+	trans   Transfer
+	path    string // where it was saved; empty for a message
+	name    string
+	size    int64
+	digest  string // SHA-256 in hex
+	message string // a message is given to the hook on stdin
+
+	extracted string // where an archive received was extracted to, if it was
+}
+
+// textEvent describes a received message
+func textEvent(message string) hookEvent {
+	sum := sha256.Sum256([]byte(message))
+	return hookEvent{
+		trans:   Transfer(wormhole.TransferText),
+		size:    int64(len(message)),
+		digest:  hex.EncodeToString(sum[:]),
+		message: message,
+	}
+}
+
+func (w *Controller) hookFor(trans Transfer) string {
+	switch trans {
+	case Transfer(wormhole.TransferFile):
+		return w.Args.Hooks.File
+	case Transfer(wormhole.TransferDirectory):
+		return w.Args.Hooks.Directory
+	case Transfer(wormhole.TransferText):
+		return w.Args.Hooks.Text
+	default:
+		return ""
+	}
+}
+
+// hookEnv is the environment the hook runs in. tmux-wormhole's own variables are left out - one
+// of them is the whole code, which is a secret.
+func (w *Controller) hookEnv(ev hookEvent) []string {
+	res := make([]string, 0, len(os.Environ())+8)
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "TMUX_WORMHOLE_") {
+			res = append(res, v)
+		}
+	}
+	return append(res,
+		"WORMHOLE_TYPE="+ev.trans.String(),
+		"WORMHOLE_PATH="+ev.path,
+		"WORMHOLE_NAME="+ev.name,
+		"WORMHOLE_SIZE="+strconv.FormatInt(ev.size, 10),
+		"WORMHOLE_SHA256="+ev.digest,
+		"WORMHOLE_NAMEPLATE="+nameplate(w.Args.Code),
+		"WORMHOLE_PANE="+w.Args.PaneID,
+		"WORMHOLE_EXTRACTED="+ev.extracted,
+	)
+}
+
+// runHook runs the hook for ev through the user's shell, in the save folder, and returns what
+// it printed. If ctx is cancelled, the hook is killed along with everything it started.
+func (w *Controller) runHook(ctx context.Context, hook string, ev hookEvent) (string, error) {
+	cmd := exec.Command(w.Args.Shell, "-c", hook)
+	cmd.Dir = w.Args.SaveDir
+	cmd.Env = w.hookEnv(ev)
+	cmd.Stdin = strings.NewReader(ev.message)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// Its own process group, so it can all be killed at once. Killing only the shell isn't
+	// enough - e.g. the sleep in "foo; sleep 600" would keep the output open, and Wait would
+	// wait for it.
+	inGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killGroup(cmd)
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+
+	res := out.String()
+	if len(res) > maxHookOutput {
+		res = res[len(res)-maxHookOutput:]
+	}
+	return res, err
+}
+
+//======================================================================
+
+// doHook runs the hook for what was just received, if there is one, and shows how it went.
+// then carries on as if there were no hook.
+func (w *Controller) doHook(ev hookEvent, then func(app gowid.IApp), app gowid.IApp) {
+	hook := w.hookFor(ev.trans)
+	if hook == "" {
+		then(app)
+		return
+	}
+
+	// The transfer is still in progress as far as Esc is concerned, so it stops the hook too
+	ctx, cancel := context.WithCancel(w.ctx)
+
+	txt := fmt.Sprintf("Running the %s hook...", ev.trans)
+	d := makeTxtDialog(txt,
+		dialog.Button{
+			Msg:    "Stop",
+			Action: &stopHook{cancel: cancel, Controller: w},
+		},
+	)
+
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: gwutil.Max(32, len(txt)+10)}, gowid.RenderFlow{}, app)
+
+	go func() {
+		defer cancel()
+		out, err := w.runHook(ctx, hook, ev)
+		app.Run(gowid.RunFunction(func(app gowid.IApp) {
+			d.Close(app)
+			w.doHookResult(ev.trans, out, err, then, app)
+		}))
+	}()
+}
+
+func (w *Controller) doHookResult(trans Transfer, out string, err error, then func(app gowid.IApp), app gowid.IApp) {
+	lines := []string{fmt.Sprintf("The %s hook finished (exit status 0).", trans)}
+	if err != nil {
+		lines[0] = fmt.Sprintf("The %s hook failed: %v", trans, err)
+	}
+	lines = append(lines, "")
+
+	cols, _ := paneSize()
+	width := gwutil.Max(20, cols-viewerExtraCols-4)
+
+	output := strings.Split(strings.TrimRight(out, "\n"), "\n")
+	switch {
+	case strings.TrimSpace(out) == "":
+		lines = append(lines, "(no output)")
+	case len(output) > maxHookLines:
+		lines = append(lines, fmt.Sprintf("... the last %d lines:", maxHookLines))
+		output = output[len(output)-maxHookLines:]
+		fallthrough
+	default:
+		for _, line := range output {
+			line = strings.Replace(line, "\t", "    ", -1)
+			if len(line) > width {
+				cut := width - 3
+				for cut > 0 && !utf8.RuneStart(line[cut]) {
+					cut--
+				}
+				line = line[:cut] + "..."
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	txt := strings.Join(lines, "\n")
+	d := makeTxtDialog(txt,
+		dialog.Button{
+			Msg:    "Continue",
+			Action: &hookContinue{then: then, Controller: w},
+		},
+	)
+
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: textWidth(txt) + 10}, gowid.RenderFlow{}, app)
+}
+
+//======================================================================
+
+type stopHook struct {
+	common
+	cancel context.CancelFunc
+	*Controller
+}
+
+// Hook running - hit Stop. The result dialog still follows, once it's gone.
+func (w stopHook) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface{}) {
+	w.cancel()
+}
+
+type hookContinue struct {
+	common
+	then func(app gowid.IApp)
+	*Controller
+}
+
+// Hook finished - hit Continue
+func (w hookContinue) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface{}) {
+	w.previous.Close(app)
+	w.then(app)
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
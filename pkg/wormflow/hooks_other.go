@@ -0,0 +1,28 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package wormflow
+
+import (
+	"os/exec"
+)
+
+//======================================================================
+
+// There are no process groups to use here, so only the shell is killed
+func inGroup(cmd *exec.Cmd) {
+}
+
+func killGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
@@ -0,0 +1,31 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package wormflow
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+//======================================================================
+
+// inGroup has cmd start in its own process group, so killGroup can kill it all at once
+func inGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killGroup kills cmd, along with everything it started
+func killGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
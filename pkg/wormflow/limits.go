@@ -0,0 +1,143 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"archive/zip"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//======================================================================
+
+// Limits protect against a directory transfer that would fill the disk - a zip bomb, or just a
+// mistake. Zero means no limit.
+type Limits struct {
+	MaxBytes int64   // total uncompressed size
+	MaxFiles int     // number of zip entries
+	MaxRatio float64 // total uncompressed size / total compressed size
+}
+
+// DefaultLimits are used unless overridden by @wormhole-max-dir-size, @wormhole-max-dir-files
+// and @wormhole-max-dir-ratio. Deflate can't do much better than 1000:1, even on zeroes.
+var DefaultLimits = Limits{
+	MaxBytes: 10 << 30,
+	MaxFiles: 100000,
+	MaxRatio: 200,
+}
+
+// LimitError explains which limit a directory transfer crossed.
+type LimitError struct {
+	What   string
+	Value  string
+	Limit  string
+	Option string // tmux option to change the limit
+}
+
+func (e LimitError) Error() string {
+	return fmt.Sprintf("%s is %s, over the limit of %s (@wormhole-%s)", e.What, e.Value, e.Limit, e.Option)
+}
+
+func (l Limits) checkBytes(n int64) error {
+	if l.MaxBytes > 0 && n > l.MaxBytes {
+		return LimitError{What: "size", Value: humanBytes(n), Limit: humanBytes(l.MaxBytes), Option: "max-dir-size"}
+	}
+	return nil
+}
+
+func (l Limits) checkFiles(n int) error {
+	if l.MaxFiles > 0 && n > l.MaxFiles {
+		return LimitError{What: "file count", Value: strconv.Itoa(n), Limit: strconv.Itoa(l.MaxFiles), Option: "max-dir-files"}
+	}
+	return nil
+}
+
+// checkOffer is a first look, using the sizes the sender claims, before the offer is accepted.
+// The zip is downloaded in full before it can be checked, so it mustn't be over the limit either
+// - whatever the sender says it holds.
+func (l Limits) checkOffer(zipped int64, uncompressed int64, files int) error {
+	if l.MaxBytes > 0 && zipped > l.MaxBytes {
+		return LimitError{What: "zip size", Value: humanBytes(zipped), Limit: humanBytes(l.MaxBytes), Option: "max-dir-size"}
+	}
+	if err := l.checkBytes(uncompressed); err != nil {
+		return err
+	}
+	return l.checkFiles(files)
+}
+
+// checkZip uses the zip's central directory, before anything is extracted. archive/zip fails
+// the read of any entry that decompresses to more than its header says, so the headers can be
+// trusted for this.
+func (l Limits) checkZip(zr *zip.Reader) error {
+	var compressed uint64
+	for _, zf := range zr.File {
+		compressed += zf.CompressedSize64
+	}
+	return l.checkEntries(zipArchive{zr}.entries(), compressed)
+}
+
+// checkEntries checks what's in an archive, whose size is compressed, before it's extracted.
+func (l Limits) checkEntries(entries []archiveEntry, compressed uint64) error {
+	if err := l.checkFiles(len(entries)); err != nil {
+		return err
+	}
+
+	var uncompressed uint64
+	for _, e := range entries {
+		// Checked as it goes, so a forged header can't make the total wrap around
+		if l.MaxBytes > 0 && e.size > uint64(l.MaxBytes) {
+			return l.tooBig()
+		}
+		uncompressed += e.size
+		if l.MaxBytes > 0 && uncompressed > uint64(l.MaxBytes) {
+			return l.tooBig()
+		}
+	}
+
+	if l.MaxRatio > 0 && compressed > 0 {
+		ratio := float64(uncompressed) / float64(compressed)
+		if ratio > l.MaxRatio {
+			return LimitError{
+				What:   "compression ratio",
+				Value:  fmt.Sprintf("%.0f:1", ratio),
+				Limit:  fmt.Sprintf("%.0f:1", l.MaxRatio),
+				Option: "max-dir-ratio",
+			}
+		}
+	}
+
+	return nil
+}
+
+// tooBig is for when the exact size isn't known, only that it's over the limit
+func (l Limits) tooBig() error {
+	return LimitError{What: "size", Value: "more than " + humanBytes(l.MaxBytes), Limit: humanBytes(l.MaxBytes), Option: "max-dir-size"}
+}
+
+//======================================================================
+
+// ParseSize converts a size like 500M or 10G to bytes. The suffixes are powers of 1024.
+func ParseSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := int64(1)
+	if num != "" {
+		if i := strings.IndexByte("KMGT", num[len(num)-1]); i != -1 {
+			mult = 1 << (10 * uint(i+1))
+			num = num[:len(num)-1]
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)/mult {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
@@ -0,0 +1,83 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gcla/gowid"
+	"github.com/gcla/gowid/gwutil"
+	"github.com/gcla/gowid/widgets/dialog"
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+//======================================================================
+
+// confirmOffer is called from the receiving goroutine once the sender's offer of a file or
+// directory arrives, before anything is read. The user is shown what it is and how big, and
+// it returns false if they'd rather not have it.
+func (w *Controller) confirmOffer(msg *wormhole.IncomingMessage, app gowid.IApp) (bool, error) {
+	c := make(chan bool, 1)
+	app.Run(gowid.RunFunction(func(app gowid.IApp) {
+		w.doOffer(msg, c, app)
+	}))
+
+	select {
+	case ok := <-c:
+		return ok, nil
+	case <-w.ctx.Done():
+		return false, w.ctx.Err()
+	}
+}
+
+// offerDetails describes an offer - the sender's own description, so the numbers are only what
+// they claim. The name is quoted, so it can't pass for anything else.
+func offerDetails(msg *wormhole.IncomingMessage) string {
+	lines := []string{
+		fmt.Sprintf("Incoming %s: %q", Transfer(msg.Type), msg.Name),
+		fmt.Sprintf("Size: %s", humanBytes(msg.UncompressedBytes64)),
+	}
+	if msg.Type == wormhole.TransferDirectory {
+		lines = append(lines, fmt.Sprintf("Files: %d", msg.FileCount))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (w *Controller) doOffer(msg *wormhole.IncomingMessage, c chan<- bool, app gowid.IApp) {
+	txt := offerDetails(msg)
+
+	d := makeTxtDialog(txt,
+		dialog.Button{
+			Msg:    "Accept",
+			Action: &accept{ok: true, c: c, Controller: w},
+		},
+		dialog.Button{
+			Msg:    "Reject",
+			Action: &accept{ok: false, c: c, Controller: w},
+		},
+	)
+
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: gwutil.Max(32, textWidth(txt)+10)}, gowid.RenderFlow{}, app)
+}
+
+type accept struct {
+	common
+	ok bool
+	c  chan<- bool
+	*Controller
+}
+
+// Offer arrived - hit Accept or Reject
+func (w accept) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface{}) {
+	w.previous.Close(app)
+	w.c <- w.ok
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
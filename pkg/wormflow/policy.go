@@ -0,0 +1,276 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+//======================================================================
+
+// What to do with an offer
+const (
+	policyAccept = "accept" // without asking
+	policyAsk    = "ask"
+	policyReject = "reject"
+)
+
+// Messages bigger than this aren't shown unless the policy's max_text says otherwise
+const defaultMaxText = 10 << 20
+
+// Policy decides what happens to each offer, before the user sees it. It's read from
+// policy.json in tmux-wormhole's config directory e.g.
+//
+//	{
+//	  "max_text": "1M",
+//	  "rules": [
+//	    {"ext": [".exe", ".sh", ".deb"], "action": "reject", "reason": "no executables"},
+//	    {"ext": [".zip", ".tar.gz"], "min_size": "100M", "host": "jump*", "action": "reject"},
+//	    {"type": "file", "max_size": "1M", "action": "accept"}
+//	  ]
+//	}
+//
+// The first rule that matches wins. If none do, the offer is handled as Default says - ask, if
+// that's empty.
+type Policy struct {
+	MaxText string       `json:"max_text,omitempty"` // largest message shown; 0 means no limit
+	Default string       `json:"default,omitempty"`
+	Rules   []PolicyRule `json:"rules"`
+
+	maxText int64
+}
+
+// PolicyRule matches an offer if everything it sets matches. Names and extensions are matched
+// ignoring case. The pane's host is the one it's logged in to with ssh, or else this one.
+type PolicyRule struct {
+	Type    string   `json:"type,omitempty"`     // file, directory or message
+	Name    string   `json:"name,omitempty"`     // glob e.g. *.iso
+	Ext     []string `json:"ext,omitempty"`      // any of these suffixes e.g. .tar.gz
+	MinSize string   `json:"min_size,omitempty"` // at least this big e.g. 100M
+	MaxSize string   `json:"max_size,omitempty"` // at most this big
+	Host    string   `json:"host,omitempty"`     // glob, matched against the pane's host, ignoring case
+	Action  string   `json:"action"`             // accept, ask or reject
+	Reason  string   `json:"reason,omitempty"`   // shown when rejecting
+
+	minSize int64
+	maxSize int64
+}
+
+// LoadPolicy reads a policy file. Anything it doesn't understand is an error, rather than a
+// rule silently not applying.
+func LoadPolicy(file string) (*Policy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var p Policy
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, err
+	}
+
+	p.maxText = defaultMaxText
+	if p.MaxText != "" {
+		if p.maxText, err = ParseSize(p.MaxText); err != nil {
+			return nil, fmt.Errorf("max_text: %v", err)
+		}
+	}
+	if err := checkAction(p.Default, true); err != nil {
+		return nil, fmt.Errorf("default: %v", err)
+	}
+
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		errf := func(format string, a ...interface{}) error {
+			return fmt.Errorf("rule %d: %s", i+1, fmt.Sprintf(format, a...))
+		}
+		switch r.Type {
+		case "", "file", "directory", "message":
+		default:
+			return nil, errf("unknown type %q - use file, directory or message", r.Type)
+		}
+		if _, err := path.Match(r.Name, ""); err != nil {
+			return nil, errf("name: %v", err)
+		}
+		if _, err := path.Match(r.Host, ""); err != nil {
+			return nil, errf("host: %v", err)
+		}
+		r.minSize, r.maxSize = -1, -1
+		if r.MinSize != "" {
+			if r.minSize, err = ParseSize(r.MinSize); err != nil {
+				return nil, errf("min_size: %v", err)
+			}
+		}
+		if r.MaxSize != "" {
+			if r.maxSize, err = ParseSize(r.MaxSize); err != nil {
+				return nil, errf("max_size: %v", err)
+			}
+		}
+		if err := checkAction(r.Action, false); err != nil {
+			return nil, errf("%v", err)
+		}
+	}
+
+	return &p, nil
+}
+
+func checkAction(action string, optional bool) error {
+	switch action {
+	case policyAccept, policyAsk, policyReject:
+		return nil
+	case "":
+		if optional {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown action %q - use accept, ask or reject", action)
+}
+
+// matches says whether the rule applies to msg. A message's size isn't known up front, so
+// rules with a size never match one - max_text covers those.
+func (r *PolicyRule) matches(msg *wormhole.IncomingMessage, host string) bool {
+	if r.Type != "" && r.Type != Transfer(msg.Type).String() {
+		return false
+	}
+	name := strings.ToLower(msg.Name)
+	if r.Name != "" {
+		if ok, _ := path.Match(strings.ToLower(r.Name), name); !ok {
+			return false
+		}
+	}
+	if len(r.Ext) > 0 {
+		found := false
+		for _, ext := range r.Ext {
+			found = found || strings.HasSuffix(name, strings.ToLower(ext))
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.minSize != -1 || r.maxSize != -1 {
+		if msg.Type == wormhole.TransferText {
+			return false
+		}
+		if r.minSize != -1 && msg.UncompressedBytes64 < r.minSize {
+			return false
+		}
+		if r.maxSize != -1 && msg.UncompressedBytes64 > r.maxSize {
+			return false
+		}
+	}
+	if r.Host != "" {
+		if ok, _ := path.Match(strings.ToLower(r.Host), strings.ToLower(host)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// decide returns what to do with msg, and why if it's rejected. A nil policy asks.
+func (p *Policy) decide(msg *wormhole.IncomingMessage, host string) (string, string) {
+	if p == nil {
+		return policyAsk, ""
+	}
+	for i := range p.Rules {
+		if r := &p.Rules[i]; r.matches(msg, host) {
+			return r.Action, r.Reason
+		}
+	}
+	if p.Default == "" {
+		return policyAsk, ""
+	}
+	return p.Default, ""
+}
+
+// maxTextBytes is the size of the biggest message that will be read; 0 means no limit
+func (p *Policy) maxTextBytes() int64 {
+	if p == nil {
+		return defaultMaxText
+	}
+	return p.maxText
+}
+
+// policyError is why the receive policy turned down an offer
+type policyError struct {
+	reason string
+}
+
+func (e policyError) Error() string {
+	if e.reason == "" {
+		return "the receive policy doesn't allow it"
+	}
+	return fmt.Sprintf("the receive policy doesn't allow it - %s", e.reason)
+}
+
+//======================================================================
+
+// Options to ssh that take an argument, so the destination isn't mistaken for one of them
+const sshArgOptions = "BbcDEeFIiJLlmOopQRSWw"
+
+// SSHHost returns the host an ssh command line connects to e.g. for
+// "ssh -p 2222 -l me jump1.example.com uptime" it's jump1.example.com. It's empty if the
+// command isn't ssh.
+func SSHHost(cmdline string) string {
+	args := strings.Fields(cmdline)
+	if len(args) == 0 || path.Base(args[0]) != "ssh" {
+		return ""
+	}
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			if i+1 < len(args) {
+				return sshDestHost(args[i+1])
+			}
+			return ""
+		}
+		if strings.HasPrefix(arg, "-") && len(arg) > 1 {
+			// e.g. -4v, -p2222, or -vp 2222
+			for j := 1; j < len(arg); j++ {
+				if strings.IndexByte(sshArgOptions, arg[j]) != -1 {
+					if j == len(arg)-1 {
+						i++
+					}
+					break
+				}
+			}
+			continue
+		}
+		return sshDestHost(arg)
+	}
+	return ""
+}
+
+// sshDestHost strips the user and port from an ssh destination, which is either
+// [user@]host or ssh://[user@]host[:port].
+func sshDestHost(dest string) string {
+	dest = strings.TrimPrefix(dest, "ssh://")
+	if i := strings.LastIndex(dest, "@"); i != -1 {
+		dest = dest[i+1:]
+	}
+	if strings.HasPrefix(dest, "[") {
+		if i := strings.Index(dest, "]"); i != -1 {
+			return dest[1:i]
+		}
+	}
+	if strings.Count(dest, ":") == 1 {
+		dest = dest[:strings.Index(dest, ":")]
+	}
+	return dest
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
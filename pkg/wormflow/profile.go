@@ -0,0 +1,71 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+//======================================================================
+
+// Profile names a rendezvous server and transit relay to use. Empty fields mean
+// wormhole-william's defaults i.e. the public magic wormhole servers.
+type Profile struct {
+	Name          string
+	RendezvousURL string
+	TransitRelay  string // host:port
+}
+
+func (p Profile) rendezvousURL() string {
+	if p.RendezvousURL == "" {
+		return wormhole.DefaultRendezvousURL
+	}
+	return p.RendezvousURL
+}
+
+// String describes the profile for displaying to the user.
+func (p Profile) String() string {
+	return fmt.Sprintf("%s (%s)", p.Name, p.rendezvousURL())
+}
+
+func (p Profile) client() wormhole.Client {
+	return wormhole.Client{
+		RendezvousURL:       p.RendezvousURL,
+		TransitRelayAddress: p.TransitRelay,
+	}
+}
+
+// ParseProfiles parses the @wormhole-profiles tmux option, a space-separated list of
+// name=rendezvous-url,transit-relay e.g.
+//
+//	corp=ws://relay.corp.example:4000/v1,transit.corp.example:4001
+//
+// Either server may be left empty to use the public default.
+func ParseProfiles(s string) ([]Profile, error) {
+	res := make([]Profile, 0)
+	for _, spec := range strings.Fields(s) {
+		eq := strings.Index(spec, "=")
+		if eq < 1 {
+			return nil, fmt.Errorf("profile %q should look like name=rendezvous-url,transit-relay", spec)
+		}
+		p := Profile{Name: spec[:eq]}
+		servers := strings.SplitN(spec[eq+1:], ",", 2)
+		p.RendezvousURL = servers[0]
+		if len(servers) > 1 {
+			p.TransitRelay = servers[1]
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
@@ -0,0 +1,120 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"fmt"
+	"time"
+)
+
+//======================================================================
+
+// The current speed is measured over this long, so it follows changes without jumping about
+// every time the progress bar is updated
+const rateWindow = 5 * time.Second
+
+// Past this, how long is left hardly matters
+const maxETA = 100 * time.Hour
+
+// transferRate works out how fast a transfer is going, and how long it has left, from the
+// byte counts seen each time the progress bar is updated.
+type transferRate struct {
+	samples []rateSample // within rateWindow of the latest, oldest first
+	start   time.Time
+}
+
+type rateSample struct {
+	at time.Time
+	n  int64
+}
+
+// newTransferRate starts measuring a transfer that starts now
+func newTransferRate() *transferRate {
+	now := time.Now()
+	return &transferRate{
+		samples: []rateSample{{at: now}},
+		start:   now,
+	}
+}
+
+// add records that n bytes have been transferred so far
+func (r *transferRate) add(n int64, at time.Time) {
+	r.samples = append(r.samples, rateSample{at: at, n: n})
+	i := 0
+	for i < len(r.samples)-2 && at.Sub(r.samples[i].at) > rateWindow {
+		i++
+	}
+	r.samples = r.samples[i:]
+}
+
+func perSecond(from rateSample, to rateSample) float64 {
+	secs := to.at.Sub(from.at).Seconds()
+	if secs <= 0 {
+		return 0
+	}
+	return float64(to.n-from.n) / secs
+}
+
+// current is the speed in bytes per second over the last few seconds
+func (r *transferRate) current() float64 {
+	if len(r.samples) < 2 {
+		return 0
+	}
+	return perSecond(r.samples[0], r.samples[len(r.samples)-1])
+}
+
+// average is the speed in bytes per second since the transfer started
+func (r *transferRate) average() float64 {
+	return perSecond(rateSample{at: r.start}, r.samples[len(r.samples)-1])
+}
+
+// describe is for the progress dialog e.g.
+//
+//	1.2 GB of 4.0 GB (30%)
+//	12.3 MB/s, 10.1 MB/s on average
+//	About 4m10s left
+func (r *transferRate) describe(done int64, total int64) string {
+	res := fmt.Sprintf("%s of %s", humanBytes(done), humanBytes(total))
+	if total > 0 {
+		res += fmt.Sprintf(" (%d%%)", done*100/total)
+	}
+
+	cur, avg := r.current(), r.average()
+	if avg <= 0 {
+		return res + "\nWaiting for data..."
+	}
+	res += fmt.Sprintf("\n%s/s, %s/s on average", humanBytes(int64(cur)), humanBytes(int64(avg)))
+
+	// The current speed says more about the rest of the transfer, unless it's stalled
+	speed := cur
+	if speed <= 0 {
+		speed = avg
+	}
+	if left := total - done; left > 0 {
+		secs := float64(left) / speed
+		if secs < maxETA.Seconds() {
+			res += fmt.Sprintf("\nAbout %v left", time.Duration(secs*float64(time.Second)).Round(time.Second))
+		} else {
+			res += fmt.Sprintf("\nMore than %.0f hours left", maxETA.Hours())
+		}
+	}
+
+	return res
+}
+
+// finished is for the progress dialog once all n bytes are done e.g.
+//
+//	4.0 GB in 6m40s, 10.1 MB/s on average
+func (r *transferRate) finished(n int64) string {
+	end := rateSample{at: time.Now(), n: n}
+	return fmt.Sprintf("%s in %v, %s/s on average", humanBytes(n), end.at.Sub(r.start).Round(time.Second),
+		humanBytes(int64(perSecond(rateSample{at: r.start}, end))))
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
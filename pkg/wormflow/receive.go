@@ -0,0 +1,469 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/gcla/gowid"
+	"github.com/gcla/gowid/widgets/progress"
+	"github.com/gcla/gowid/widgets/spinner"
+	"github.com/gcla/gowid/widgets/text"
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+//======================================================================
+
+// receiveText receives msg, a message, and shows it. It can't be turned down, so it's always
+// received - but the receive policy can stop it being shown.
+func (w showCodeOk) receiveText(msg *wormhole.IncomingMessage, app gowid.IApp) {
+	if action, reason := w.Args.Policy.decide(msg, w.Args.Host); action == policyReject {
+		app.Run(gowid.RunFunction(func(app gowid.IApp) {
+			w.previous.Close(app)
+			w.doLimitExceeded("the message", policyError{reason: reason}, app)
+		}))
+		return
+	}
+
+	spin := spinner.New(spinner.Options{
+		Styler: gowid.MakePaletteRef("progress-spinner"),
+	})
+
+	app.Run(gowid.RunFunction(func(app gowid.IApp) {
+		w.previous.Close(app)
+		w.doSpin(spin, app)
+	}))
+
+	done := make(chan struct{})
+	var transferredMessage []byte
+	var err error
+
+	go func() {
+		var r io.Reader = newCtxReader(w.ctx, msg)
+		limit := w.Args.Policy.maxTextBytes()
+		if limit > 0 {
+			r = io.LimitReader(r, limit+1)
+		}
+		transferredMessage, err = ioutil.ReadAll(r)
+		if err == nil && limit > 0 && int64(len(transferredMessage)) > limit {
+			err = fmt.Errorf("it's over the limit of %s (max_text in the receive policy)", humanBytes(limit))
+		}
+
+		defer close(done)
+
+		if err != nil {
+			return
+		}
+
+		// Artificial delay makes a nicer experience
+		time.Sleep(1000 * time.Millisecond)
+	}()
+
+	go func() {
+		c := time.Tick(100 * time.Millisecond)
+	loop:
+		for {
+			select {
+			case <-done:
+				app.Run(gowid.RunFunction(func(app gowid.IApp) {
+					w.previous.Close(app)
+					switch {
+					case w.cancelled():
+						w.doCancelled(app)
+					case err != nil:
+						w.doTextTransferError(err, app)
+					default:
+						message := string(transferredMessage)
+						w.doHook(textEvent(message), func(app gowid.IApp) {
+							w.doReceivedText(message, app)
+						}, app)
+					}
+				}))
+				break loop
+			case <-c:
+				app.Run(gowid.RunFunction(func(app gowid.IApp) {
+					spin.Update()
+				}))
+			}
+		}
+	}()
+}
+
+//======================================================================
+
+// receiving is a file or directory being received, once it's been accepted. Its worker
+// goroutine fills in how it went, then closes done; watch shows its progress until then, and
+// finishReceiving says how it went.
+type receiving struct {
+	read  int64 // only via sync/atomic - it's written as the data arrives. First, so it's aligned.
+	msg   *wormhole.IncomingMessage
+	prog  *progress.Widget
+	stats *text.Widget
+	rate  *transferRate
+	phase string // shown above the download's progress, if there's more to do after it
+	ep    extractProgress
+	done  chan struct{}
+
+	// Only touched by the UI goroutine. If there's something to extract, the speed is only of
+	// the download, so it's worked out once that's over.
+	downloaded string
+
+	// Set by the worker before done is closed. If verified is nil, it wasn't saved - failed
+	// says why, unless it was cancelled.
+	saved    string // what's left in the save folder, to run the hook on and open
+	verified *verification
+	failed   func(app gowid.IApp)
+}
+
+// startReceiving shows the progress dialog for msg. Once the worker's started, call watch.
+func (w showCodeOk) startReceiving(msg *wormhole.IncomingMessage, phase string, app gowid.IApp) *receiving {
+	r := &receiving{
+		msg: msg,
+		prog: progress.New(progress.Options{
+			Normal:   gowid.MakePaletteRef("progress-default"),
+			Complete: gowid.MakePaletteRef("progress-complete"),
+		}),
+		stats: text.New(""),
+		rate:  newTransferRate(),
+		phase: phase,
+		done:  make(chan struct{}),
+	}
+
+	app.Run(gowid.RunFunction(func(app gowid.IApp) {
+		w.previous.Close(app)
+		w.doProg(msg.Name, Transfer(msg.Type), r.prog, r.stats, app)
+	}))
+
+	return r
+}
+
+// reader returns msg's data, counting what's read for the progress bar
+func (r *receiving) reader(ctx context.Context) io.Reader {
+	return &progReader{read: &r.read, Reader: newCtxReader(ctx, r.msg)}
+}
+
+// fail records why r wasn't saved, for show to display once the worker's done
+func (r *receiving) fail(show func(err error, app gowid.IApp), err error) {
+	r.failed = func(app gowid.IApp) {
+		show(err, app)
+	}
+}
+
+// watch updates the progress dialog until r's worker is done, then ends the transfer
+func (w showCodeOk) watch(r *receiving, app gowid.IApp) {
+	c := time.Tick(250 * time.Millisecond)
+	for {
+		select {
+		case <-r.done:
+			app.Run(gowid.RunFunction(func(app gowid.IApp) {
+				w.finishReceiving(r, app)
+			}))
+			return
+		case t := <-c:
+			app.Run(gowid.RunFunction(func(app gowid.IApp) {
+				st := r.ep.get()
+				if !st.started {
+					n := atomic.LoadInt64(&r.read)
+					r.rate.add(n, t)
+					r.stats.SetText(r.phase+r.rate.describe(n, r.msg.TransferBytes64), app)
+					r.prog.SetTarget(app, int(r.msg.TransferBytes64))
+					r.prog.SetProgress(app, int(n))
+					return
+				}
+				if r.downloaded == "" {
+					r.downloaded = r.rate.finished(r.msg.TransferBytes64)
+				}
+				r.stats.SetText(st.describe(), app)
+				// Files can be empty, so make sure the bar still moves
+				r.prog.SetTarget(app, int(st.totalBytes)+st.totalFiles)
+				r.prog.SetProgress(app, int(st.bytes)+st.files)
+			}))
+		}
+	}
+}
+
+// finishReceiving says how r went, once its worker's done. Once it's saved, cancelling only
+// stops what comes after e.g. extracting an archive - it's still saved.
+func (w showCodeOk) finishReceiving(r *receiving, app gowid.IApp) {
+	v := r.verified
+	if v == nil {
+		w.previous.Close(app)
+		if w.cancelled() {
+			w.doCancelled(app)
+		} else {
+			r.failed(app)
+		}
+		return
+	}
+
+	if w.record != nil {
+		w.record.Extracted = v.dropped
+	}
+	w.finishRecord(outcomeSaved, r.saved, nil)
+	w.verified = v
+
+	if r.downloaded == "" {
+		r.downloaded = r.rate.finished(r.msg.TransferBytes64)
+	}
+	finished := r.downloaded
+	if v.dir || v.extracted != "" {
+		st := r.ep.get()
+		finished = fmt.Sprintf("Downloaded %s\nExtracted %d files, %s", finished, st.totalFiles,
+			humanBytes(st.totalBytes))
+	}
+	r.stats.SetText(finished, app)
+	r.prog.SetTarget(app, 1)
+	r.prog.SetProgress(app, 1)
+
+	// Delay at 100% is nice
+	time.AfterFunc(1*time.Second, func() {
+		app.Run(gowid.RunFunction(func(app gowid.IApp) {
+			w.previous.Close(app)
+
+			ev := hookEvent{
+				trans:     Transfer(r.msg.Type),
+				path:      r.saved,
+				name:      r.msg.Name,
+				size:      v.size,
+				digest:    v.digest,
+				extracted: v.extracted,
+			}
+			w.doHook(ev, func(app gowid.IApp) {
+				switch {
+				case v.dir || w.Args.OpenCmd == "":
+					w.doSavedAs(r.saved, app)
+				case w.Args.NoAskOpen:
+					w.doOpen(r.saved, app)
+				default:
+					w.doAskToOpen(r.saved, app)
+				}
+			}, app)
+		}))
+	})
+}
+
+//======================================================================
+
+// receiveFile receives msg, a file, into d. It returns false if it didn't get as far as
+// starting, having said why - then msg and d are still the caller's. Otherwise d is closed once
+// the file's saved.
+func (w showCodeOk) receiveFile(msg *wormhole.IncomingMessage, d *saveDir, app gowid.IApp) bool {
+	savedName, mode, ok, err := w.resolveConflict(d, msg.Name, app)
+	if !ok {
+		app.Run(gowid.RunFunction(func(app gowid.IApp) {
+			w.previous.Close(app)
+			w.doNotReceived(msg.Name, err, app)
+		}))
+		return false
+	}
+
+	// Receive into a hidden file, and only move it to savedFilename once it's complete
+	savedFilename := d.join(savedName)
+	f, err := d.createPartial(savedName)
+	if err != nil {
+		app.Run(gowid.RunFunction(func(app gowid.IApp) {
+			w.previous.Close(app)
+			w.doFileCreateError(savedFilename, err, app)
+		}))
+		return false
+	}
+
+	r := w.startReceiving(msg, "", app)
+
+	go func() {
+		defer close(r.done)
+		defer d.Close()
+
+		h := sha256.New()
+		err := d.savePartial(f, io.TeeReader(r.reader(w.ctx), h), msg.UncompressedBytes64, savedName, mode)
+		var leftErr error
+		if leftBehind(err) {
+			leftErr, err = err, nil
+		}
+		if err != nil {
+			r.fail(func(err error, app gowid.IApp) { w.doFileTransferError(savedFilename, err, app) }, err)
+			return
+		}
+
+		// savePartial fails unless every byte the sender promised arrived
+		verified := &verification{
+			size:     msg.UncompressedBytes64,
+			expected: msg.UncompressedBytes64,
+			digest:   hex.EncodeToString(h.Sum(nil)),
+			shown:    paneDigests(w.Args.Pane, w.Args.Code),
+			leftErr:  leftErr,
+		}
+		if w.Args.Sidecar {
+			verified.sidecar, verified.sidecarErr = d.writeSidecar(savedName, verified.digest, mode)
+		}
+
+		// The file's saved whatever happens here - if it can't be extracted, that's reported
+		// alongside
+		if w.Args.Extract {
+			verified.extracted, verified.extractErr = extractReceived(w.ctx, d, savedName, w.Args.Limits, &r.ep)
+			if verified.extracted != "" {
+				st := r.ep.get()
+				verified.extractedFiles, verified.extractedBytes = st.totalFiles, st.totalBytes
+				if w.Args.DropArchive {
+					verified.dropErr = d.removeAll(savedName)
+					verified.dropped = verified.dropErr == nil
+				}
+			}
+		}
+
+		// What's left once the archive's gone is what it was extracted to
+		r.saved = savedFilename
+		if verified.dropped {
+			r.saved = verified.extracted
+		}
+		r.verified = verified
+	}()
+
+	go w.watch(r, app)
+
+	return true
+}
+
+// receiveDirectory receives msg, a directory sent as a zip, into d. It returns false if it
+// didn't get as far as starting, having said why - then msg and d are still the caller's.
+// Otherwise d is closed once the directory's saved.
+func (w showCodeOk) receiveDirectory(msg *wormhole.IncomingMessage, d *saveDir, app gowid.IApp) bool {
+	savedName, mode, ok, err := w.resolveConflict(d, msg.Name, app)
+	if !ok {
+		app.Run(gowid.RunFunction(func(app gowid.IApp) {
+			w.previous.Close(app)
+			w.doNotReceived(msg.Name, err, app)
+		}))
+		return false
+	}
+
+	// Extract into a hidden directory, and only move it to dirName once it's complete -
+	// anything already there is left alone until then
+	dirName := d.join(savedName)
+	tmpDir, err := d.mkdirPartial(savedName)
+	if err != nil {
+		app.Run(gowid.RunFunction(func(app gowid.IApp) {
+			w.previous.Close(app)
+			w.doError(err, app)
+		}))
+		return false
+	}
+
+	tmpFile, err := d.createPartial(savedName + ".zip")
+	if err != nil {
+		err = d.discard(tmpDir, err)
+		app.Run(gowid.RunFunction(func(app gowid.IApp) {
+			w.previous.Close(app)
+			w.doError(err, app)
+		}))
+		return false
+	}
+
+	r := w.startReceiving(msg, "Downloading\n", app)
+
+	go func() {
+		// The half-extracted tree is removed first, so if that fails too, it's said
+		fail := func(show func(err error, app gowid.IApp), err error) {
+			r.fail(show, d.discard(tmpDir, err))
+		}
+		transferError := func(err error, app gowid.IApp) { w.doFileTransferError(msg.Name, err, app) }
+		limitExceeded := func(err error, app gowid.IApp) { w.doLimitExceeded(fmt.Sprintf("%q", msg.Name), err, app) }
+
+		defer func() {
+			tmpFile.Close()
+			d.removeAll(filepath.Base(tmpFile.Name()))
+			// If it was cancelled - otherwise it's in place, or fail removed it
+			if r.verified == nil && r.failed == nil {
+				d.discard(tmpDir, nil)
+			}
+			d.Close()
+			close(r.done)
+		}()
+
+		h := sha256.New()
+		// No more than the sender said - that's what the limits were checked against
+		n, err := io.Copy(io.MultiWriter(tmpFile, h), io.LimitReader(r.reader(w.ctx), msg.TransferBytes64+1))
+		if err == nil && n > msg.TransferBytes64 {
+			err = fmt.Errorf("the sender sent more than the %d bytes it offered", msg.TransferBytes64)
+		}
+
+		if w.cancelled() {
+			return
+		}
+
+		if err != nil {
+			fail(transferError, err)
+			return
+		}
+
+		tmpFile.Seek(0, io.SeekStart)
+		zr, err := zip.NewReader(tmpFile, int64(n))
+		if err != nil {
+			fail(w.doError, err)
+			return
+		}
+
+		// The sender's numbers can't be trusted - check what will actually be extracted, and
+		// that there's still room for it
+		err = w.Args.Limits.checkZip(zr)
+		if err == nil {
+			err = d.checkSpace(extractedSize(zipArchive{zr}.entries()))
+		}
+		if err != nil {
+			fail(limitExceeded, err)
+			return
+		}
+
+		if err := extractZip(w.ctx, zr, d, tmpDir, &r.ep); err != nil {
+			if !w.cancelled() {
+				fail(w.doError, err)
+			}
+			return
+		}
+
+		// archive/zip fails any entry that doesn't match its header, so this is what was
+		// extracted
+		var size int64
+		for _, zf := range zr.File {
+			size += int64(zf.UncompressedSize64)
+		}
+		verified := &verification{
+			size:     size,
+			expected: msg.UncompressedBytes64,
+			digest:   hex.EncodeToString(h.Sum(nil)),
+			dir:      true,
+			shown:    paneDigests(w.Args.Pane, w.Args.Code),
+		}
+
+		if err := d.place(tmpDir, savedName, mode); leftBehind(err) {
+			verified.leftErr = err
+		} else if err != nil {
+			fail(w.doError, err)
+			return
+		}
+
+		r.saved = dirName
+		r.verified = verified
+	}()
+
+	go w.watch(r, app)
+
+	return true
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
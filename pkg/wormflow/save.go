@@ -0,0 +1,215 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+//======================================================================
+
+// saveDir is the folder things are received into. It's opened once, and everything received
+// is created in it by name, relative to that handle - exclusively, so nothing is ever written
+// through a symlink planted there, and nothing is replaced that the user didn't agree to.
+type saveDir struct {
+	path string
+	f    *os.File
+}
+
+func openSaveDir(path string) (*saveDir, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%s is not a directory", path)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &saveDir{path: path, f: f}, nil
+}
+
+func (d *saveDir) Close() error {
+	return d.f.Close()
+}
+
+// checkName makes sure a name chosen by the sender is a plain name in the save folder, not a
+// path to somewhere else. Control characters aren't allowed either - a newline in a name could
+// fake a line in the dialogs that show it.
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") ||
+		strings.IndexFunc(name, unicode.IsControl) != -1 {
+		return fmt.Errorf("the sender's name %q is not allowed", name)
+	}
+	return nil
+}
+
+func (d *saveDir) join(name string) string {
+	return filepath.Join(d.path, name)
+}
+
+// rel returns the name of p, a path below the save folder, relative to it
+func (d *saveDir) rel(p string) string {
+	res, err := filepath.Rel(d.path, p)
+	if err != nil {
+		return p
+	}
+	return res
+}
+
+// createPartial creates a hidden file next to name to receive into, e.g. .foo.txt.1234.part
+// for foo.txt. It's created with the same permissions os.Create would use.
+func (d *saveDir) createPartial(name string) (*os.File, error) {
+	for i := 0; i < 100; i++ {
+		f, err := d.create(fmt.Sprintf(".%s.%d.part", name, partialSuffix()))
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+	return nil, fmt.Errorf("could not create a temporary file for %s", d.join(name))
+}
+
+// partialSuffix makes the names of partial files hard to guess, so they can't be planted in
+// advance.
+func partialSuffix() uint32 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// O_EXCL still protects the file - this is only its name
+		return uint32(time.Now().UnixNano())
+	}
+	return binary.LittleEndian.Uint32(b[:])
+}
+
+// mkdirPartial creates a hidden directory next to name to extract into, e.g. .foo.1234.part
+// for foo, and returns its name.
+func (d *saveDir) mkdirPartial(name string) (string, error) {
+	for i := 0; i < 100; i++ {
+		res := fmt.Sprintf(".%s.%d.part", name, partialSuffix())
+		err := d.mkdir(res)
+		if os.IsExist(err) {
+			continue
+		}
+		return res, err
+	}
+	return "", fmt.Errorf("could not create a temporary directory for %s", d.join(name))
+}
+
+// discard removes dir, a directory made here to receive or extract into, along with whatever got
+// into it before err. It's only for directories made by mkdir or mkdirPartial - nothing else can
+// be in one, so it's safe to remove the half-extracted tree. It returns err, saying so if dir
+// couldn't be removed too - it's hidden, so otherwise nobody would know it was there.
+func (d *saveDir) discard(dir string, err error) error {
+	rerr := d.removeAll(dir)
+	switch {
+	case rerr == nil:
+		return err
+	case err == nil:
+		return rerr
+	default:
+		return fmt.Errorf("%v - and it couldn't be cleaned up: %v", err, rerr)
+	}
+}
+
+// leftBehindError means something was saved, replacing what was there - but the old copy,
+// moved aside, couldn't be removed.
+type leftBehindError struct {
+	path string
+	err  error
+}
+
+func (e leftBehindError) Error() string {
+	return fmt.Sprintf("the old copy was left behind as %q: %v", e.path, e.err)
+}
+
+// leftBehind returns true if err is only a leftBehindError - it was saved after all
+func leftBehind(err error) bool {
+	_, ok := err.(leftBehindError)
+	return ok
+}
+
+// savePartial copies r into f, a file made by createPartial, and moves it to name only if all
+// size bytes arrived. Otherwise f is removed, so a half-written file is never seen at name.
+// Anything already at name is dealt with as mode says - see place, including for a
+// leftBehindError.
+func (d *saveDir) savePartial(f *os.File, r io.Reader, size int64, name string, mode replaceMode) error {
+	n, err := io.Copy(f, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("received %d bytes, expected %d", n, size)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = d.place(filepath.Base(f.Name()), name, mode)
+	}
+	if err != nil && !leftBehind(err) {
+		d.removeAll(filepath.Base(f.Name()))
+	}
+	return err
+}
+
+// place moves partial, a complete file or directory made by createPartial or mkdirPartial, to
+// name. Only now is anything already at name replaced or backed up, as mode says - so if the
+// transfer fails, it's left alone. If partial can't be moved, what was at name is put back. If
+// partial's in place but what it replaced can't be removed, that's a leftBehindError.
+func (d *saveDir) place(partial string, name string, mode replaceMode) error {
+	switch mode {
+	case replaceBackup:
+		backup := backupName(d, name)
+		if err := d.renameNoReplace(name, backup); err != nil {
+			return err
+		}
+		if err := d.renameNoReplace(partial, name); err != nil {
+			d.renameNoReplace(backup, name)
+			return err
+		}
+		return nil
+
+	case replaceExisting:
+		// A file replaces a file in one go, but rename won't replace a directory that isn't empty,
+		// or one with the other - so move the old one aside, and only remove it once the new
+		// one's in place
+		if !d.isDir(name) && !d.isDir(partial) {
+			return d.rename(partial, name)
+		}
+		aside := fmt.Sprintf(".%s.%d.old", name, partialSuffix())
+		if err := d.renameNoReplace(name, aside); err != nil && d.exists(name) {
+			return err
+		}
+		if err := d.renameNoReplace(partial, name); err != nil {
+			d.renameNoReplace(aside, name)
+			return err
+		}
+		if err := d.removeAll(aside); err != nil {
+			return leftBehindError{path: d.join(aside), err: err}
+		}
+		return nil
+
+	default:
+		return d.renameNoReplace(partial, name)
+	}
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
@@ -0,0 +1,351 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+//======================================================================
+
+// On Linux, names are resolved relative to the open save folder with the *at syscalls, so it
+// doesn't matter if the folder's path is changed to point somewhere else mid-transfer. A name
+// may be a path below the folder e.g. foo/bar/baz.txt. Each directory on the way is opened
+// with O_NOFOLLOW, so nothing is ever reached through a symlink.
+
+// Not exported by syscall
+const (
+	atRemoveDir         = 0x200
+	renameNoReplaceFlag = 0x1
+	oPath               = 0x200000 // the same everywhere, but syscall only has it for some architectures
+)
+
+// syscall only has renameat2 for the newer architectures
+var sysRenameat2 = map[string]uintptr{
+	"386": 353, "amd64": 316, "arm": 382, "arm64": 276, "loong64": 276, "mips": 4351, "mipsle": 4351,
+	"mips64": 5311, "mips64le": 5311, "ppc64": 357, "ppc64le": 357, "riscv64": 276, "s390x": 347,
+}[runtime.GOARCH]
+
+const dirFlags = syscall.O_RDONLY | syscall.O_DIRECTORY | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+
+func (d *saveDir) fd() int {
+	return int(d.f.Fd())
+}
+
+// openParent opens the directory holding name, one level at a time from the save folder, and
+// returns it with the last part of name. The caller closes it.
+func (d *saveDir) openParent(name string) (int, string, error) {
+	parts := strings.Split(name, string(filepath.Separator))
+	fd, err := syscall.Openat(d.fd(), ".", dirFlags, 0)
+	if err != nil {
+		return -1, "", &os.PathError{Op: "open", Path: d.path, Err: err}
+	}
+	for i, part := range parts[:len(parts)-1] {
+		next, err := syscall.Openat(fd, part, dirFlags, 0)
+		syscall.Close(fd)
+		if err != nil {
+			return -1, "", &os.PathError{Op: "open", Path: d.join(filepath.Join(parts[:i+1]...)), Err: err}
+		}
+		fd = next
+	}
+	return fd, parts[len(parts)-1], nil
+}
+
+// lstat doesn't follow name if it's a symlink. O_PATH opens anything, even a symlink, just to
+// stat it.
+func (d *saveDir) lstat(name string) (*syscall.Stat_t, error) {
+	pfd, base, err := d.openParent(name)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(pfd)
+
+	fd, err := syscall.Openat(pfd, base, oPath|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: d.join(name), Err: err}
+	}
+	defer syscall.Close(fd)
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: d.join(name), Err: err}
+	}
+	return &st, nil
+}
+
+// exists doesn't follow symlinks - a dangling one still takes up the name
+func (d *saveDir) exists(name string) bool {
+	_, err := d.lstat(name)
+	return !os.IsNotExist(err)
+}
+
+func (d *saveDir) isDir(name string) bool {
+	st, err := d.lstat(name)
+	return err == nil && st.Mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+// open opens the file name to read
+func (d *saveDir) open(name string) (*os.File, error) {
+	pfd, base, err := d.openParent(name)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(pfd)
+
+	fd, err := syscall.Openat(pfd, base, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: d.join(name), Err: err}
+	}
+	return os.NewFile(uintptr(fd), d.join(name)), nil
+}
+
+// create makes a new file. O_EXCL means it fails if name exists, even as a dangling symlink.
+func (d *saveDir) create(name string) (*os.File, error) {
+	pfd, base, err := d.openParent(name)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(pfd)
+
+	flags := syscall.O_RDWR | syscall.O_CREAT | syscall.O_EXCL | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+	fd, err := syscall.Openat(pfd, base, flags, 0666)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: d.join(name), Err: err}
+	}
+	return os.NewFile(uintptr(fd), d.join(name)), nil
+}
+
+func (d *saveDir) mkdir(name string) error {
+	pfd, base, err := d.openParent(name)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(pfd)
+
+	if err := syscall.Mkdirat(pfd, base, 0777); err != nil {
+		return &os.PathError{Op: "mkdir", Path: d.join(name), Err: err}
+	}
+	return nil
+}
+
+// mkdirAll makes name and any directories above it that don't exist. A symlink on the way is
+// an error, not followed.
+func (d *saveDir) mkdirAll(name string) error {
+	fd, err := syscall.Openat(d.fd(), ".", dirFlags, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: d.path, Err: err}
+	}
+	cur := d.path
+	for _, part := range strings.Split(name, string(filepath.Separator)) {
+		cur = filepath.Join(cur, part)
+		err := syscall.Mkdirat(fd, part, 0777)
+		if err == nil || err == syscall.EEXIST {
+			var next int
+			if next, err = syscall.Openat(fd, part, dirFlags, 0); err == nil {
+				syscall.Close(fd)
+				fd = next
+				continue
+			}
+		}
+		syscall.Close(fd)
+		return &os.PathError{Op: "mkdir", Path: cur, Err: err}
+	}
+	syscall.Close(fd)
+	return nil
+}
+
+// openDir opens the directory name, to set its attributes
+func (d *saveDir) openDir(name string) (*os.File, error) {
+	pfd, base, err := d.openParent(name)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(pfd)
+
+	fd, err := syscall.Openat(pfd, base, dirFlags, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: d.join(name), Err: err}
+	}
+	return os.NewFile(uintptr(fd), d.join(name)), nil
+}
+
+// symlink makes name a link to target. It fails if name exists.
+func (d *saveDir) symlink(target string, name string) error {
+	pfd, base, err := d.openParent(name)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(pfd)
+
+	if err := symlinkat(target, pfd, base); err != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: d.join(name), Err: err}
+	}
+	return nil
+}
+
+// rename replaces to if it exists. A symlink at to is replaced, not followed.
+func (d *saveDir) rename(from string, to string) error {
+	if err := syscall.Renameat(d.fd(), from, d.fd(), to); err != nil {
+		return &os.LinkError{Op: "rename", Old: d.join(from), New: d.join(to), Err: err}
+	}
+	return nil
+}
+
+// renameNoReplace is rename, but fails if to already exists - in one go, so nothing can appear
+// at to in between. On a filesystem without RENAME_NOREPLACE a file is moved with a hard link
+// instead, which can't replace anything either. A directory can't be, so that fails.
+func (d *saveDir) renameNoReplace(from string, to string) error {
+	err := renameat2(d.fd(), from, d.fd(), to, renameNoReplaceFlag)
+	if err == syscall.ENOSYS || err == syscall.EINVAL {
+		if err = linkat(d.fd(), from, d.fd(), to); err == nil {
+			err = unlinkat(d.fd(), from, 0)
+		}
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: d.join(from), New: d.join(to), Err: err}
+	}
+	return nil
+}
+
+// removeAll removes name and, if it's a directory, everything in it. Symlinks are removed,
+// not followed. A directory the owner can't change, e.g. a read-only copy of a Go module cache,
+// is made writable first.
+func (d *saveDir) removeAll(name string) error {
+	pfd, base, err := d.openParent(name)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(pfd)
+
+	if err := removeAllAt(pfd, base); err != nil {
+		return &os.PathError{Op: "remove", Path: d.join(name), Err: err}
+	}
+	return nil
+}
+
+func removeAllAt(dirfd int, name string) error {
+	err := syscall.Unlinkat(dirfd, name)
+	if err == nil || err == syscall.ENOENT {
+		return nil
+	}
+	if err != syscall.EISDIR {
+		return err
+	}
+
+	fd, err := syscall.Openat(dirfd, name, dirFlags, 0)
+	if err != nil {
+		return err
+	}
+	dir := os.NewFile(uintptr(fd), name)
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err == nil && st.Mode&0700 != 0700 {
+		err = syscall.Fchmod(fd, st.Mode&07777|0700)
+	}
+	if err != nil {
+		dir.Close()
+		return err
+	}
+	names, err := dir.Readdirnames(-1)
+	for i := 0; err == nil && i < len(names); i++ {
+		err = removeAllAt(fd, names[i])
+	}
+	dir.Close()
+	if err != nil {
+		return err
+	}
+
+	return unlinkat(dirfd, name, atRemoveDir)
+}
+
+// setTimes sets the modification time of the open file f
+func setTimes(f *os.File, t time.Time) error {
+	tv := syscall.NsecToTimeval(t.UnixNano())
+	if err := syscall.Futimes(int(f.Fd()), []syscall.Timeval{tv, tv}); err != nil {
+		return &os.PathError{Op: "chtimes", Path: f.Name(), Err: err}
+	}
+	return nil
+}
+
+//======================================================================
+
+// syscall has no symlinkat, linkat, renameat2, or unlinkat with flags
+
+func symlinkat(target string, dirfd int, name string) error {
+	t, err := syscall.BytePtrFromString(target)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_SYMLINKAT, uintptr(unsafe.Pointer(t)), uintptr(dirfd),
+		uintptr(unsafe.Pointer(n)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func linkat(olddirfd int, oldname string, newdirfd int, newname string) error {
+	o, err := syscall.BytePtrFromString(oldname)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.BytePtrFromString(newname)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LINKAT, uintptr(olddirfd), uintptr(unsafe.Pointer(o)),
+		uintptr(newdirfd), uintptr(unsafe.Pointer(n)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func renameat2(olddirfd int, oldname string, newdirfd int, newname string, flags int) error {
+	if sysRenameat2 == 0 {
+		return syscall.ENOSYS
+	}
+	o, err := syscall.BytePtrFromString(oldname)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.BytePtrFromString(newname)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(sysRenameat2, uintptr(olddirfd), uintptr(unsafe.Pointer(o)),
+		uintptr(newdirfd), uintptr(unsafe.Pointer(n)), uintptr(flags), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func unlinkat(dirfd int, name string, flags int) error {
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_UNLINKAT, uintptr(dirfd), uintptr(unsafe.Pointer(n)), uintptr(flags))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
@@ -0,0 +1,160 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+//go:build !linux
+// +build !linux
+
+package wormflow
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//======================================================================
+
+// Without the *at syscalls, names are resolved from the save folder's path. A name may be a
+// path below the folder e.g. foo/bar/baz.txt - each directory on the way is checked for
+// symlinks first, and O_EXCL still means nothing is created through one.
+
+// create makes a new file. O_EXCL means it fails if name exists, even as a dangling symlink.
+func (d *saveDir) create(name string) (*os.File, error) {
+	if err := checkNoLinks(d.path, d.join(filepath.Dir(name))); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(d.join(name), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+}
+
+func (d *saveDir) mkdir(name string) error {
+	if err := checkNoLinks(d.path, d.join(filepath.Dir(name))); err != nil {
+		return err
+	}
+	return os.Mkdir(d.join(name), 0777)
+}
+
+// mkdirAll makes name and any directories above it that don't exist. A symlink on the way is
+// an error, not followed.
+func (d *saveDir) mkdirAll(name string) error {
+	if err := checkNoLinks(d.path, d.join(name)); err != nil {
+		return err
+	}
+	return os.MkdirAll(d.join(name), 0777)
+}
+
+// openDir opens the directory name, to set its attributes
+func (d *saveDir) openDir(name string) (*os.File, error) {
+	if err := checkNoLinks(d.path, d.join(name)); err != nil {
+		return nil, err
+	}
+	return os.Open(d.join(name))
+}
+
+// symlink makes name a link to target. It fails if name exists.
+func (d *saveDir) symlink(target string, name string) error {
+	if err := checkNoLinks(d.path, d.join(filepath.Dir(name))); err != nil {
+		return err
+	}
+	return os.Symlink(target, d.join(name))
+}
+
+// exists doesn't follow symlinks - a dangling one still takes up the name
+func (d *saveDir) exists(name string) bool {
+	_, err := os.Lstat(d.join(name))
+	return !os.IsNotExist(err)
+}
+
+func (d *saveDir) isDir(name string) bool {
+	info, err := os.Lstat(d.join(name))
+	return err == nil && info.IsDir()
+}
+
+// open opens the file name to read
+func (d *saveDir) open(name string) (*os.File, error) {
+	if err := checkNoLinks(d.path, d.join(name)); err != nil {
+		return nil, err
+	}
+	return os.Open(d.join(name))
+}
+
+// renameNoReplace is rename, but fails if to already exists. A hard link can't replace
+// anything, so that's tried first. Directories and some filesystems can't be hard linked, so
+// then fall back to checking beforehand.
+func (d *saveDir) renameNoReplace(from string, to string) error {
+	err := os.Link(d.join(from), d.join(to))
+	switch {
+	case err == nil:
+		return os.Remove(d.join(from))
+	case os.IsExist(err), d.exists(to):
+		return &os.LinkError{Op: "rename", Old: d.join(from), New: d.join(to), Err: os.ErrExist}
+	default:
+		return d.rename(from, to)
+	}
+}
+
+// rename replaces to if it exists. A symlink at to is replaced, not followed.
+func (d *saveDir) rename(from string, to string) error {
+	return os.Rename(d.join(from), d.join(to))
+}
+
+// removeAll removes name and, if it's a directory, everything in it. Symlinks are removed,
+// not followed. A directory the owner can't change, e.g. a read-only copy of a Go module cache,
+// is made writable first.
+func (d *saveDir) removeAll(name string) error {
+	if err := checkNoLinks(d.path, d.join(filepath.Dir(name))); err != nil {
+		return err
+	}
+	p := d.join(name)
+	if err := os.RemoveAll(p); err == nil {
+		return nil
+	}
+	// Walk sees each directory before reading it, so it can make it readable in time
+	filepath.Walk(p, func(q string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && info.Mode().Perm()&0700 != 0700 {
+			os.Chmod(q, info.Mode().Perm()|0700)
+		}
+		return nil
+	})
+	return os.RemoveAll(p)
+}
+
+// setTimes sets the modification time of the open file f
+func setTimes(f *os.File, t time.Time) error {
+	return os.Chtimes(f.Name(), t, t)
+}
+
+// checkNoLinks fails if any existing path from dir down to p, including p, is a symlink -
+// writing to p would follow it somewhere else.
+func checkNoLinks(dir string, p string) error {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+	cur := dir
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		cur = filepath.Join(cur, part)
+		info, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to write through the symlink %s", cur)
+		}
+	}
+	return nil
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
@@ -0,0 +1,539 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/gcla/gowid"
+	"github.com/gcla/gowid/gwutil"
+	"github.com/gcla/gowid/widgets/button"
+	"github.com/gcla/gowid/widgets/dialog"
+	"github.com/gcla/gowid/widgets/divider"
+	"github.com/gcla/gowid/widgets/edit"
+	"github.com/gcla/gowid/widgets/list"
+	"github.com/gcla/gowid/widgets/pile"
+	"github.com/gcla/gowid/widgets/progress"
+	"github.com/gcla/gowid/widgets/styled"
+	"github.com/gcla/gowid/widgets/text"
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+//======================================================================
+
+// How many entries of a directory to show at once in the file browser
+const maxBrowserRows = 12
+
+// doPickFile shows the contents of dir. Choosing a directory browses into it; choosing a
+// file sends it. When sending a directory, only directories are listed, and the first
+// entry sends the one being displayed.
+func (w *Controller) doPickFile(dir string, app gowid.IApp) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		w.doError(err, app)
+		return
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		w.doError(err, app)
+		return
+	}
+
+	var d *dialog.Widget
+
+	pickDir := w.Args.Mode == ModeSendDirectory
+
+	txt := fmt.Sprintf("Send a file from %s", dir)
+	if pickDir {
+		txt = fmt.Sprintf("Send a directory from %s", dir)
+	}
+	wid := len(txt)
+	entries := make([]gowid.IWidget, 0, len(infos)+1)
+
+	addEntry := func(label string, fn func(app gowid.IApp)) {
+		btn := button.NewBare(text.New(label))
+		btn.OnClick(gowid.WidgetCallback{
+			Name: "cb",
+			WidgetChangedFunction: func(app gowid.IApp, _ gowid.IWidget) {
+				d.Close(app)
+				fn(app)
+			},
+		})
+		entries = append(entries, styled.NewExt(btn, gowid.MakePaletteRef("dialog"), gowid.MakePaletteRef("button-focus")))
+		wid = gwutil.Max(wid, len(label))
+	}
+
+	if pickDir {
+		addEntry("./ (send this directory)", func(app gowid.IApp) {
+			w.doConfirmSendDirectory(dir, app)
+		})
+	}
+
+	if parent := filepath.Dir(dir); parent != dir {
+		addEntry("../", func(app gowid.IApp) {
+			w.doPickFile(parent, app)
+		})
+	}
+
+	// Follow symlinks so a link to a directory can be browsed
+	for i, info := range infos {
+		if info.Mode()&os.ModeSymlink != 0 {
+			if target, err := os.Stat(filepath.Join(dir, info.Name())); err == nil {
+				infos[i] = target
+			}
+		}
+	}
+
+	// ReadDir sorts by name - keep that order, but put directories first
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].IsDir() && !infos[j].IsDir()
+	})
+
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		switch {
+		case info.IsDir():
+			addEntry(info.Name()+"/", func(app gowid.IApp) {
+				w.doPickFile(path, app)
+			})
+		case info.Mode().IsRegular() && !pickDir:
+			addEntry(info.Name(), func(app gowid.IApp) {
+				w.doSendFile(path, app)
+			})
+		}
+	}
+
+	rows := pile.NewFlow(
+		text.New(txt),
+		divider.NewBlank(),
+		&gowid.ContainerWidget{
+			IWidget: list.New(list.NewSimpleListWalker(entries)),
+			D:       gowid.RenderWithUnits{U: gwutil.Max(1, gwutil.Min(maxBrowserRows, len(entries)))},
+		},
+	)
+
+	d = makeInputDialog(rows,
+		gowid.RenderFlow{},
+		dialog.Button{
+			Msg:    "Cancel",
+			Action: &quit{Controller: w},
+		},
+	)
+
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: wid + 10}, gowid.RenderFlow{}, app)
+}
+
+//======================================================================
+
+func (w *Controller) doSendFile(path string, app gowid.IApp) {
+	f, err := os.Open(path)
+	if err != nil {
+		w.doError(err, app)
+		return
+	}
+
+	name := filepath.Base(path)
+
+	status := text.New(fmt.Sprintf("Getting a code for %s...", name))
+	prog := progress.New(progress.Options{
+		Normal:   gowid.MakePaletteRef("progress-default"),
+		Complete: gowid.MakePaletteRef("progress-complete"),
+	})
+
+	d := w.doSendProg(status, gwutil.Max(32, len(name)+40), prog, app)
+
+	w.inTransfer = true
+	w.startRecord(historyEntry{Direction: "send", Type: "file", Name: name, Path: path})
+
+	client := w.client()
+	sp := &sendProgress{}
+
+	go func() {
+		defer f.Close()
+
+		code, res, err := client.SendFile(w.ctx, name, f, sp.option())
+
+		w.waitForSend(name, code, res, err, sp, d, status, prog, app)
+	}()
+}
+
+// waitForSend runs in its own goroutine. It shows the code the sender should give to the remote
+// side, then updates the progress bar until wormhole-william reports the outcome.
+func (w *Controller) waitForSend(name string, code string, res chan wormhole.SendResult, err error,
+	sp *sendProgress, d *dialog.Widget, status *text.Widget, prog *progress.Widget, app gowid.IApp) {
+
+	if err != nil {
+		app.Run(gowid.RunFunction(func(app gowid.IApp) {
+			d.Close(app)
+			if w.cancelled() {
+				w.doCancelled(app)
+			} else {
+				w.doSendError(name, err, app)
+			}
+		}))
+		return
+	}
+
+	app.Run(gowid.RunFunction(func(app gowid.IApp) {
+		if w.record != nil {
+			w.record.Nameplate = nameplate(code)
+		}
+		status.SetText(fmt.Sprintf("Wormhole code is %s\n\nWaiting for the receiver...", code), app)
+	}))
+
+	connected := false
+	c := time.Tick(250 * time.Millisecond)
+loop:
+	for {
+		select {
+		case r := <-res:
+			app.Run(gowid.RunFunction(func(app gowid.IApp) {
+				d.Close(app)
+				switch {
+				case w.cancelled():
+					w.doCancelled(app)
+				case r.Error != nil:
+					w.doSendError(name, r.Error, app)
+				case !r.OK:
+					w.doSendError(name, fmt.Errorf("transfer was not completed"), app)
+				default:
+					if w.record != nil && w.record.Size == 0 {
+						_, w.record.Size = sp.get()
+					}
+					w.finishRecord(outcomeSent, "", nil)
+					w.doMessageThenQuit(fmt.Sprintf("Sent %s.", name), "Ok", app)
+				}
+			}))
+			break loop
+		case <-w.ctx.Done():
+			app.Run(gowid.RunFunction(func(app gowid.IApp) {
+				d.Close(app)
+				w.doCancelled(app)
+			}))
+			break loop
+		case <-c:
+			app.Run(gowid.RunFunction(func(app gowid.IApp) {
+				sent, total := sp.get()
+				if total == 0 {
+					return
+				}
+				if !connected {
+					connected = true
+					status.SetText(fmt.Sprintf("Wormhole code is %s\n\nSending %s...", code, name), app)
+				}
+				prog.SetTarget(app, int(total))
+				prog.SetProgress(app, int(sent))
+			}))
+		}
+	}
+}
+
+//======================================================================
+
+// Rows given to the message editor when sending text
+const textEditorRows = 8
+
+// doEditText lets the user review or write the message to send. It starts off holding the
+// most recent tmux paste buffer, if there is one.
+func (w *Controller) doEditText(initial string, app gowid.IApp) {
+	ed := edit.New(edit.Options{
+		Text: initial,
+	})
+
+	rows := pile.NewFlow(
+		text.New("Message to send:"),
+		divider.NewBlank(),
+		&gowid.ContainerWidget{
+			IWidget: ed,
+			D:       gowid.RenderWithUnits{U: textEditorRows},
+		},
+	)
+
+	d := makeInputDialog(rows,
+		gowid.RenderFlow{},
+		dialog.Button{
+			Msg:    "Send",
+			Action: &sendText{editor: ed, Controller: w},
+		},
+		dialog.Button{
+			Msg:    "Cancel",
+			Action: &quit{Controller: w},
+		},
+	)
+
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithRatio{R: 0.8}, gowid.RenderFlow{}, app)
+}
+
+type sendText struct {
+	common
+	editor *edit.Widget
+	*Controller
+}
+
+// Edit the message - hit Send button
+func (w sendText) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface{}) {
+	msg := w.editor.Text()
+	if msg == "" {
+		return
+	}
+	w.previous.Close(app)
+	w.doSendText(msg, app)
+}
+
+func (w *Controller) doSendText(msg string, app gowid.IApp) {
+	status := text.New("Getting a code for the message...")
+	prog := progress.New(progress.Options{
+		Normal:   gowid.MakePaletteRef("progress-default"),
+		Complete: gowid.MakePaletteRef("progress-complete"),
+	})
+
+	d := w.doSendProg(status, 60, prog, app)
+
+	w.inTransfer = true
+	w.startRecord(historyEntry{Direction: "send", Type: "message", Size: int64(len(msg))})
+
+	client := w.client()
+	sp := &sendProgress{}
+
+	go func() {
+		code, res, err := client.SendText(w.ctx, msg, sp.option())
+
+		w.waitForSend("message", code, res, err, sp, d, status, prog, app)
+	}()
+}
+
+// pasteBuffer returns the contents of the most recent tmux paste buffer. tmux-wormhole runs in a
+// pane of the user's own tmux server, so this is the buffer they'd get with prefix-].
+func pasteBuffer() string {
+	out, err := exec.Command("tmux", "show-buffer").Output()
+	if err != nil {
+		// e.g. no buffers yet
+		return ""
+	}
+	return string(out)
+}
+
+//======================================================================
+
+// doConfirmSendDirectory collects the files to send and shows how many there are, and how
+// big they are in total, before anything is zipped.
+func (w *Controller) doConfirmSendDirectory(dir string, app gowid.IApp) {
+	entries, size, err := directoryEntries(dir)
+	if err != nil {
+		w.doError(err, app)
+		return
+	}
+
+	if len(entries) == 0 {
+		w.doMessageThenQuit(fmt.Sprintf("%s has no files to send.", dir), "Quit", app)
+		return
+	}
+
+	txt := fmt.Sprintf("Send directory %s (%d files, %s)?", filepath.Base(dir), len(entries), humanBytes(size))
+
+	d := makeTxtDialog(txt,
+		dialog.Button{
+			Msg:    "Send",
+			Action: &sendDirectory{dir: dir, entries: entries, size: size, Controller: w},
+		},
+		dialog.Button{
+			Msg:    "Cancel",
+			Action: &quit{Controller: w},
+		},
+	)
+
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: len(txt) + 10}, gowid.RenderFlow{}, app)
+}
+
+type sendDirectory struct {
+	common
+	dir     string
+	entries []dirEntry
+	size    int64
+	*Controller
+}
+
+// Confirm the directory - hit Send button
+func (w sendDirectory) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface{}) {
+	w.previous.Close(app)
+	w.doSendDirectory(w.dir, w.entries, w.size, app)
+}
+
+func (w *Controller) doSendDirectory(dir string, entries []dirEntry, size int64, app gowid.IApp) {
+	name := filepath.Base(dir)
+
+	status := text.New(fmt.Sprintf("Zipping %s (%d files, %s)...", name, len(entries), humanBytes(size)))
+	prog := progress.New(progress.Options{
+		Normal:   gowid.MakePaletteRef("progress-default"),
+		Complete: gowid.MakePaletteRef("progress-complete"),
+	})
+
+	d := w.doSendProg(status, gwutil.Max(32, len(name)+40), prog, app)
+
+	w.inTransfer = true
+	w.startRecord(historyEntry{Direction: "send", Type: "directory", Name: name, Path: dir, Size: size})
+
+	client := w.client()
+	sp := &sendProgress{}
+
+	wentries := make([]wormhole.DirectoryEntry, 0, len(entries))
+	for _, e := range entries {
+		wentries = append(wentries, e.wormholeEntry(name, sp))
+	}
+
+	go func() {
+		// SendDirectory zips everything to a temp file before it returns the code, so track
+		// how much of the directory has been read into the zip until then.
+		zipped := make(chan struct{})
+		go func() {
+			c := time.Tick(250 * time.Millisecond)
+			for {
+				select {
+				case <-zipped:
+					return
+				case <-c:
+					app.Run(gowid.RunFunction(func(app gowid.IApp) {
+						prog.SetTarget(app, int(size))
+						prog.SetProgress(app, int(atomic.LoadInt64(&sp.zipped)))
+					}))
+				}
+			}
+		}()
+
+		code, res, err := client.SendDirectory(w.ctx, name, wentries, sp.option())
+		close(zipped)
+
+		app.Run(gowid.RunFunction(func(app gowid.IApp) {
+			prog.SetProgress(app, 0)
+		}))
+
+		w.waitForSend(name, code, res, err, sp, d, status, prog, app)
+	}()
+}
+
+// dirEntry is a regular file found under the directory being sent
+type dirEntry struct {
+	path string // on disk
+	rel  string // relative to the directory being sent, slash-separated
+	mode os.FileMode
+}
+
+// wormholeEntry converts e for SendDirectory, which wants each path prefixed with the name
+// of the directory. Bytes read while zipping are counted in sp.
+func (e dirEntry) wormholeEntry(dirName string, sp *sendProgress) wormhole.DirectoryEntry {
+	return wormhole.DirectoryEntry{
+		Path: dirName + "/" + e.rel,
+		Mode: e.mode,
+		Reader: func() (io.ReadCloser, error) {
+			f, err := os.Open(e.path)
+			if err != nil {
+				return nil, err
+			}
+			return &zipReader{ReadCloser: f, zipped: &sp.zipped}, nil
+		},
+	}
+}
+
+// directoryEntries walks dir and returns the regular files in it, and their total size.
+// Anything else - sockets, devices, symlinks - is left out.
+func directoryEntries(dir string) ([]dirEntry, int64, error) {
+	var res []dirEntry
+	var size int64
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		res = append(res, dirEntry{path: path, rel: filepath.ToSlash(rel), mode: info.Mode()})
+		size += info.Size()
+		return nil
+	})
+
+	return res, size, err
+}
+
+// zipReader counts the bytes read from a file as it's added to the zip.
+type zipReader struct {
+	io.ReadCloser
+	zipped *int64
+}
+
+func (r *zipReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(r.zipped, int64(n))
+	return n, err
+}
+
+//======================================================================
+
+func (w *Controller) doSendProg(status *text.Widget, wid int, prog *progress.Widget, app gowid.IApp) *dialog.Widget {
+	rows := pile.NewFlow(
+		status,
+		divider.NewBlank(),
+		prog,
+	)
+
+	d := makeDialog(rows,
+		gowid.RenderFlow{},
+		dialog.Button{
+			Msg:    "Cancel",
+			Action: &cancelTransfer{Controller: w},
+		},
+	)
+
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: wid}, gowid.RenderFlow{}, app)
+
+	return d
+}
+
+//======================================================================
+
+func (w *Controller) doSendError(name string, err error, app gowid.IApp) {
+	w.finishRecord(outcomeFailed, "", err)
+	w.doMessageThenQuit(fmt.Sprintf("Error sending %s: %v", name, err), "Quit", app)
+}
+
+//======================================================================
+
+// sendProgress is updated from wormhole-william's goroutine via the WithProgress callback, and
+// read by the ticker that updates the progress bar.
+type sendProgress struct {
+	sent   int64
+	total  int64
+	zipped int64 // directories only
+}
+
+func (p *sendProgress) option() wormhole.SendOption {
+	return wormhole.WithProgress(func(sent int64, total int64) {
+		atomic.StoreInt64(&p.sent, sent)
+		atomic.StoreInt64(&p.total, total)
+	})
+}
+
+func (p *sendProgress) get() (int64, int64) {
+	return atomic.LoadInt64(&p.sent), atomic.LoadInt64(&p.total)
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
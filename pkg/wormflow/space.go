@@ -0,0 +1,68 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+//======================================================================
+
+// errSpaceUnknown means free space can't be checked here, so the transfer goes ahead
+var errSpaceUnknown = errors.New("free space unknown")
+
+// SpaceError means the save folder doesn't have room for what's offered.
+type SpaceError struct {
+	Dir       string
+	Needed    int64
+	Available int64
+}
+
+func (e SpaceError) Error() string {
+	return fmt.Sprintf("it needs %s free in %s, but only %s is available", humanBytes(e.Needed), e.Dir,
+		humanBytes(e.Available))
+}
+
+// spaceNeeded is how much room msg will take up while it's received. A directory arrives as a
+// zip, which is kept next to the tree it's extracted to until the end, so needs room for both.
+func spaceNeeded(msg *wormhole.IncomingMessage) int64 {
+	if msg.Type == wormhole.TransferDirectory {
+		return msg.TransferBytes64 + msg.UncompressedBytes64
+	}
+	return msg.UncompressedBytes64
+}
+
+// extractedSize is how much room entries take up once extracted. Their sizes come from an
+// archive's headers, so may be anything - the total stops short of wrapping around.
+func extractedSize(entries []archiveEntry) int64 {
+	var res uint64
+	for _, e := range entries {
+		if e.size > math.MaxInt64-res {
+			return math.MaxInt64
+		}
+		res += e.size
+	}
+	return int64(res)
+}
+
+// checkSpace fails if there isn't room for needed bytes in the save folder. If free space can't
+// be found, it's assumed there's room - running out will still be caught, just later.
+func (d *saveDir) checkSpace(needed int64) error {
+	free, err := d.freeSpace()
+	if err != nil || needed <= free {
+		return nil
+	}
+	return SpaceError{Dir: d.path, Needed: needed, Available: free}
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
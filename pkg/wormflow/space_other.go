@@ -0,0 +1,20 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package wormflow
+
+//======================================================================
+
+func (d *saveDir) freeSpace() (int64, error) {
+	return 0, errSpaceUnknown
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
@@ -0,0 +1,30 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package wormflow
+
+import (
+	"syscall"
+)
+
+//======================================================================
+
+// freeSpace is the space in the save folder's filesystem available to an ordinary user -
+// root's reserved blocks don't count.
+func (d *saveDir) freeSpace() (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Fstatfs(int(d.f.Fd()), &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
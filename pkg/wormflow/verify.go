@@ -0,0 +1,156 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gcla/gowid/gwutil"
+)
+
+//======================================================================
+
+var (
+	// Colors and the like - the pane is captured with capture-pane -e
+	escapeRe = regexp.MustCompile(`\x1b\[[0-9;:?]*[ -/]*[@-~]`)
+	digestRe = regexp.MustCompile(`\b[0-9a-fA-F]{64}\b`)
+)
+
+// How many lines above or below the code a SHA-256 can be and still count as next to it
+const digestLines = 2
+
+// paneDigests returns every SHA-256, in lower case hex, found next to code in the pane. A
+// sender can print one alongside the code e.g. sha256sum foo; wormhole send foo.
+func paneDigests(pane string, code string) []string {
+	if code == "" {
+		return nil
+	}
+
+	lines := strings.Split(escapeRe.ReplaceAllString(pane, ""), "\n")
+	res := make([]string, 0)
+	seen := make(map[string]bool)
+	for i, line := range lines {
+		if !strings.Contains(line, code) {
+			continue
+		}
+		for j := gwutil.Max(0, i-digestLines); j <= gwutil.Min(len(lines)-1, i+digestLines); j++ {
+			for _, digest := range digestRe.FindAllString(lines[j], -1) {
+				digest = strings.ToLower(digest)
+				if !seen[digest] {
+					seen[digest] = true
+					res = append(res, digest)
+				}
+			}
+		}
+	}
+	return res
+}
+
+//======================================================================
+
+// verification is what's known about something received once it's saved, for the completion
+// dialog.
+type verification struct {
+	size       int64  // bytes saved - for a directory, the total extracted
+	expected   int64  // what the sender said
+	digest     string // SHA-256 in hex - for a directory, of the zip as it was sent
+	dir        bool
+	shown      []string // SHA-256s found next to the code in the pane
+	sidecar    string   // checksum file written, if any
+	sidecarErr error    // if it's a leftBehindError, it was still written
+	leftErr    error    // a leftBehindError - it was saved, but what it replaced is still there
+
+	// If it's an archive, and @wormhole-extract-archives is set
+	extracted      string // the directory it was extracted to
+	extractedFiles int
+	extractedBytes int64
+	extractErr     error
+	dropped        bool // the archive was removed once extracted
+	dropErr        error
+}
+
+func (v *verification) String() string {
+	lines := make([]string, 0, 4)
+
+	if v.size == v.expected {
+		lines = append(lines, fmt.Sprintf("Size: %s (%d bytes), as expected", humanBytes(v.size), v.size))
+	} else {
+		lines = append(lines, fmt.Sprintf("Size: %d bytes - the sender said %d", v.size, v.expected))
+	}
+
+	if v.dir {
+		lines = append(lines, fmt.Sprintf("SHA-256 of zip: %s", v.digest))
+	} else {
+		lines = append(lines, fmt.Sprintf("SHA-256: %s", v.digest))
+	}
+
+	if len(v.shown) > 0 {
+		matched := false
+		for _, digest := range v.shown {
+			matched = matched || digest == v.digest
+		}
+		if matched {
+			lines = append(lines, "Matches the SHA-256 next to the code.")
+		} else {
+			lines = append(lines, fmt.Sprintf("MISMATCH - the pane shows %s", v.shown[0]))
+		}
+	}
+
+	if v.leftErr != nil {
+		lines = append(lines, fmt.Sprintf("Saved, but %v", v.leftErr))
+	}
+
+	switch {
+	case v.sidecar != "" && v.sidecarErr != nil:
+		lines = append(lines, fmt.Sprintf("Written to %q, but %v", v.sidecar, v.sidecarErr))
+	case v.sidecarErr != nil:
+		lines = append(lines, fmt.Sprintf("Not written to a .sha256 file: %v", v.sidecarErr))
+	case v.sidecar != "":
+		lines = append(lines, fmt.Sprintf("Written to %q", v.sidecar))
+	}
+
+	switch {
+	case v.extractErr != nil:
+		lines = append(lines, fmt.Sprintf("Not extracted: %v", v.extractErr))
+	case v.extracted != "":
+		lines = append(lines, fmt.Sprintf("Extracted %d files, %s, to %q", v.extractedFiles,
+			humanBytes(v.extractedBytes), v.extracted))
+		switch {
+		case v.dropErr != nil:
+			lines = append(lines, fmt.Sprintf("The archive couldn't be removed: %v", v.dropErr))
+		case v.dropped:
+			lines = append(lines, "The archive was removed.")
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// writeSidecar writes digest to name.sha256, next to the file it's the checksum of, in the
+// format sha256sum -c checks. An existing name.sha256 is replaced, or backed up, only if name
+// was.
+func (d *saveDir) writeSidecar(name string, digest string, mode replaceMode) (string, error) {
+	sidecar := name + ".sha256"
+	f, err := d.createPartial(sidecar)
+	if err != nil {
+		return "", err
+	}
+	line := fmt.Sprintf("%s  %s\n", digest, name)
+	if err := d.savePartial(f, strings.NewReader(line), int64(len(line)), sidecar, mode); err != nil {
+		if leftBehind(err) {
+			return d.join(sidecar), err
+		}
+		return "", err
+	}
+	return d.join(sidecar), nil
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
@@ -0,0 +1,224 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/gcla/gowid"
+	"github.com/gcla/gowid/gwutil"
+	"github.com/gcla/gowid/widgets/columns"
+	"github.com/gcla/gowid/widgets/dialog"
+	"github.com/gcla/gowid/widgets/divider"
+	"github.com/gcla/gowid/widgets/edit"
+	"github.com/gcla/gowid/widgets/list"
+	"github.com/gcla/gowid/widgets/pile"
+	"github.com/gcla/gowid/widgets/selectable"
+	"github.com/gcla/gowid/widgets/styled"
+	"github.com/gcla/gowid/widgets/text"
+	"github.com/gdamore/tcell"
+)
+
+//======================================================================
+
+// Rows and columns of the viewer taken up by the dialog's frame, title, find box and buttons
+const (
+	viewerExtraRows = 12
+	viewerExtraCols = 8
+)
+
+// A received message fits in an ordinary dialog if it's one line, and that line fits in the pane
+func fitsDialog(message string, cols int) bool {
+	return !strings.Contains(strings.TrimRight(message, "\n"), "\n") && len(message)+10 <= cols
+}
+
+// paneSize returns the size of the pane tmux-wormhole is running in, which is the size of the
+// pane it replaced.
+func paneSize() (int, int) {
+	out, err := exec.Command("tmux", "display-message", "-p", "#{pane_width} #{pane_height}").Output()
+	if err == nil {
+		if f := strings.Fields(string(out)); len(f) == 2 {
+			cols, err1 := strconv.Atoi(f[0])
+			rows, err2 := strconv.Atoi(f[1])
+			if err1 == nil && err2 == nil {
+				return cols, rows
+			}
+		}
+	}
+	return 80, 24
+}
+
+// doViewText shows a long message a line at a time, numbered and wrapped to fit the pane, so it
+// can be scrolled through. Enter in the find box moves to the next line that matches.
+func (w *Controller) doViewText(message string, app gowid.IApp) {
+	w.inTransfer = false
+
+	cols, rows := paneSize()
+	width := gwutil.Max(20, cols-viewerExtraCols)
+
+	lines := strings.Split(strings.TrimRight(message, "\n"), "\n")
+	numWidth := len(strconv.Itoa(len(lines)))
+
+	// Wrapped, how many rows the message needs - so a short one gets a small viewer
+	needed := 0
+	texts := make([]*text.Widget, 0, len(lines))
+	entries := make([]gowid.IWidget, 0, len(lines))
+	for i, line := range lines {
+		line = strings.Replace(line, "\t", "    ", -1)
+		lines[i] = line
+		needed += 1 + len(line)/gwutil.Max(1, width-numWidth-1)
+
+		txt := text.New(line)
+		texts = append(texts, txt)
+		row := columns.New([]gowid.IContainerWidget{
+			&gowid.ContainerWidget{
+				IWidget: text.New(fmt.Sprintf("%*d", numWidth, i+1)),
+				D:       gowid.RenderWithUnits{U: numWidth + 1},
+			},
+			&gowid.ContainerWidget{
+				IWidget: txt,
+				D:       gowid.RenderWithWeight{W: 1},
+			},
+		})
+		entries = append(entries, styled.NewExt(selectable.New(row), gowid.MakePaletteRef("dialog"), gowid.MakePaletteRef("button-focus")))
+	}
+
+	walker := list.NewSimpleListWalker(entries)
+
+	status := text.New(fmt.Sprintf("%d lines", len(lines)))
+
+	// Index of the line showing a match, so it can be unhighlighted when moving on
+	matched := -1
+
+	find := edit.New(edit.Options{Caption: "Find: "})
+	findBox := &keyCatcher{
+		IWidget: find,
+		fn: func(app gowid.IApp, ev *tcell.EventKey) bool {
+			if ev.Key() != tcell.KeyEnter || find.Text() == "" {
+				return false
+			}
+			// Pressing Enter again finds the next one
+			start := int(walker.Focus().(list.ListPos))
+			if matched != -1 {
+				start++
+			}
+			i, from, to := findLine(lines, find.Text(), start)
+			if matched != -1 {
+				texts[matched].SetText(lines[matched], app)
+				matched = -1
+			}
+			if i == -1 {
+				status.SetText("Not found", app)
+				return true
+			}
+			texts[i].SetContent(app, text.NewContent([]text.ContentSegment{
+				text.StringContent(lines[i][:from]),
+				text.StyledContent(lines[i][from:to], gowid.MakePaletteRef("button-focus")),
+				text.StringContent(lines[i][to:]),
+			}))
+			matched = i
+			walker.SetFocus(list.ListPos(i), app)
+			status.SetText(fmt.Sprintf("Line %d of %d", i+1, len(lines)), app)
+			return true
+		},
+	}
+
+	view := pile.NewFlow(
+		status,
+		divider.NewBlank(),
+		&gowid.ContainerWidget{
+			IWidget: list.New(walker),
+			D:       gowid.RenderWithUnits{U: gwutil.Max(3, gwutil.Min(needed, rows-viewerExtraRows))},
+		},
+		divider.NewBlank(),
+		findBox,
+	)
+
+	d := makeInputDialog(view,
+		gowid.RenderFlow{},
+		w.textButtons(message,
+			dialog.Button{
+				Msg:    "Save",
+				Action: &saveText{message: message, Controller: w},
+			},
+		)...,
+	)
+
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: width + 4}, gowid.RenderFlow{}, app)
+}
+
+// findLine returns the index of the first of lines, from start onwards and wrapping around,
+// containing s, ignoring case - and where in that line it starts and ends. The index is -1 if
+// there isn't one.
+func findLine(lines []string, s string, start int) (int, int, int) {
+	for n := 0; n < len(lines); n++ {
+		i := (start + n) % len(lines)
+		line, sub := strings.ToLower(lines[i]), strings.ToLower(s)
+		// ToLower can change the length of some strings, so only trust it if it doesn't
+		if len(line) != len(lines[i]) {
+			line, sub = lines[i], s
+		}
+		if pos := strings.Index(line, sub); pos != -1 {
+			return i, pos, pos + len(sub)
+		}
+	}
+	return -1, -1, -1
+}
+
+//======================================================================
+
+type saveText struct {
+	common
+	message string
+	*Controller
+}
+
+// Message received - hit Save
+func (w saveText) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface{}) {
+	w.previous.Close(app)
+	savedFilename, err := w.saveText(w.message)
+	if err != nil {
+		w.doTextError(w.message, fmt.Sprintf("Error saving: %v", err), app)
+		return
+	}
+	w.doSavedAs(savedFilename, app)
+}
+
+// saveText writes a received message to the save folder, as wormhole-message.txt or, if that
+// exists, wormhole-message (1).txt and so on.
+func (w *Controller) saveText(message string) (string, error) {
+	d, err := openSaveDir(w.Args.SaveDir)
+	if err != nil {
+		return "", err
+	}
+	defer d.Close()
+
+	name := "wormhole-message.txt"
+	if d.exists(name) {
+		name = numberedName(d, name)
+	}
+
+	f, err := d.create(name)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(message)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return d.join(name), nil
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
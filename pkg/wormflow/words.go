@@ -0,0 +1,130 @@
+// Copyright 2021 Graham Clark. All rights reserved.  Use of this source
+// code is governed by the MIT license that can be found in the LICENSE
+// file.
+
+package wormflow
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//======================================================================
+
+// wordList is the PGP word list used by magic wormhole codes. tmux-wormhole.sh passes the 256
+// even words followed by the 256 odd words.
+type wordList struct {
+	even []string
+	odd  []string
+}
+
+func newWordList(words []string) wordList {
+	var res wordList
+	if len(words) == 512 {
+		res.even = words[:256]
+		res.odd = words[256:]
+	} else {
+		// Not what's expected, but still useful for completion
+		res.even = words
+		res.odd = words
+	}
+	return res
+}
+
+// forPosition returns the words that can appear at index i of a code, not counting the
+// nameplate. Like magic-wormhole, the first word is odd, then they alternate.
+func (l wordList) forPosition(i int) []string {
+	if i%2 == 0 {
+		return l.odd
+	}
+	return l.even
+}
+
+// complete extends the last word of a partly typed code e.g. "7-cross" becomes "7-crossover-".
+// If the word is ambiguous, it is extended as far as possible and the candidates are returned.
+func (l wordList) complete(code string) (string, []string) {
+	parts := strings.Split(code, "-")
+	if len(parts) == 1 {
+		if isNameplate(code) {
+			return code + "-", nil
+		}
+		return code, nil
+	}
+
+	last := strings.ToLower(parts[len(parts)-1])
+	prefix := code[:len(code)-len(last)]
+
+	matches := prefixMatches(l.forPosition(len(parts)-2), last)
+	if len(matches) == 0 {
+		// Be forgiving if the sender's words are in an unexpected order
+		matches = prefixMatches(append(append([]string{}, l.even...), l.odd...), last)
+	}
+
+	switch len(matches) {
+	case 0:
+		return code, nil
+	case 1:
+		return prefix + matches[0] + "-", nil
+	default:
+		return prefix + commonPrefix(matches), matches
+	}
+}
+
+func prefixMatches(words []string, prefix string) []string {
+	res := make([]string, 0)
+	for _, w := range words {
+		if strings.HasPrefix(w, prefix) {
+			res = append(res, w)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func commonPrefix(words []string) string {
+	res := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, res) {
+			res = res[:len(res)-1]
+		}
+	}
+	return res
+}
+
+// checkCode tidies up a code typed by the user, and makes sure it looks like a wormhole code
+// i.e. a numeric nameplate followed by at least one word.
+func checkCode(code string) (string, error) {
+	code = strings.Trim(strings.TrimSpace(code), "-")
+	parts := strings.Split(code, "-")
+	if !isNameplate(parts[0]) {
+		return code, fmt.Errorf("the code must start with a number e.g. 7-crossover-clockwork")
+	}
+	if len(parts) < 2 {
+		return code, fmt.Errorf("the code needs at least one word after the number")
+	}
+	for _, p := range parts[1:] {
+		if p == "" {
+			return code, fmt.Errorf("the code has an empty word")
+		}
+	}
+	return strings.ToLower(code), nil
+}
+
+func isNameplate(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+//======================================================================
+// Local Variables:
+// mode: Go
+// fill-column: 110
+// End:
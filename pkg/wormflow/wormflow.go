@@ -3,49 +3,104 @@
 // file.
 
 // Package wormflow contains code that provides the UI for tmux-wormhole's
-// magic-wormhole file-receiving feature.
+// magic-wormhole file-receiving and file-sending features.
 package wormflow
 
 import (
-	"archive/zip"
 	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
-	"time"
+	"sync/atomic"
+	"unicode/utf8"
 
 	"github.com/alessio/shellescape"
 	"github.com/gcla/gowid"
 	"github.com/gcla/gowid/gwutil"
 	"github.com/gcla/gowid/widgets/dialog"
 	"github.com/gcla/gowid/widgets/divider"
+	"github.com/gcla/gowid/widgets/edit"
 	"github.com/gcla/gowid/widgets/framed"
 	"github.com/gcla/gowid/widgets/hpadding"
 	"github.com/gcla/gowid/widgets/pile"
 	"github.com/gcla/gowid/widgets/progress"
 	"github.com/gcla/gowid/widgets/spinner"
 	"github.com/gcla/gowid/widgets/text"
+	"github.com/gdamore/tcell"
 	"github.com/psanford/wormhole-william/wormhole"
 )
 
 //======================================================================
 
 type Args struct {
-	Code      string
-	SaveDir   string
-	OpenCmd   string
-	NoAskOpen bool
-	Shell     string
-	Overwrite bool
-	Lower     gowid.ISettableComposite
+	Mode        Mode
+	Code        string
+	Hints       map[string]string // label -> code, if several codes were found in the pane
+	Words       []string          // PGP word list, for completing a code typed in by hand
+	OnPick      func(code string) // called on the UI goroutine when one of several codes is picked
+	SaveDir     string
+	StartDir    string // where the file browser starts when sending
+	OpenCmd     string
+	Profiles    []Profile // servers to choose from; if empty, the public ones are used
+	Profile     int       // index into Profiles of the one to start with
+	NoAskOpen   bool
+	Shell       string
+	Overwrite   bool
+	Limits      Limits   // for directories; the zero value means no limits
+	CopyTo      CopyMode // where the Copy button puts a received message
+	PasteBuffer string   // tmux-wormhole.sh pastes this tmux buffer into the original pane afterwards
+	History     string   // JSON lines file that transfers are logged to; empty means don't
+	Pane        string   // what the pane held, to look for a SHA-256 next to the code
+	Sidecar     bool     // write a .sha256 file next to each file received
+	Policy      *Policy  // what to do with each offer; nil means ask
+	Host        string   // the host the pane is on, for the policy
+	Hooks       Hooks    // run once something is received
+	PaneID      string   // the pane tmux-wormhole was started from, for hooks
+	Extract     bool     // extract a received .tar.gz, .tar.zst, .tar or .zip next to it
+	DropArchive bool     // remove the archive once it's been extracted
+	Lower       gowid.ISettableComposite
 }
 
 type Controller struct {
 	Args
+	ctx        context.Context // cancelled if the user hits Cancel mid-transfer
+	cancel     context.CancelFunc
+	inTransfer bool          // only accessed from the UI goroutine
+	profile    int           // index into Args.Profiles
+	record     *historyEntry // the transfer in progress, until it's logged
+	verified   *verification // shown once something received is saved
+}
+
+// Mode determines whether the controller receives using a code found in the pane, or
+// sends something from the local machine and displays the code it generates.
+type Mode int
+
+const (
+	ModeReceive Mode = iota
+	ModeSendFile
+	ModeSendText
+	ModeSendDirectory
+	ModeHistory
+)
+
+// ParseMode converts the mode passed in by the tmux-wormhole shell script. An empty
+// string means receive, which is what the default key binding does.
+func ParseMode(s string) (Mode, error) {
+	switch s {
+	case "", "receive":
+		return ModeReceive, nil
+	case "send-file":
+		return ModeSendFile, nil
+	case "send-text":
+		return ModeSendText, nil
+	case "send-dir":
+		return ModeSendDirectory, nil
+	case "history":
+		return ModeHistory, nil
+	default:
+		return ModeReceive, fmt.Errorf("unknown mode %q", s)
+	}
 }
 
 // Transfer exists to provide a simple description of the wormhole transfer type
@@ -68,22 +123,66 @@ func (tt Transfer) String() string {
 //======================================================================
 
 func New(args Args) *Controller {
+	ctx, cancel := context.WithCancel(context.Background())
 	res := &Controller{
-		Args: args,
+		Args:    args,
+		ctx:     ctx,
+		cancel:  cancel,
+		profile: args.Profile,
+	}
+	if res.profile < 0 || res.profile >= len(args.Profiles) {
+		res.profile = 0
 	}
 	return res
 }
 
+func (w *Controller) currentProfile() Profile {
+	if len(w.Args.Profiles) == 0 {
+		return Profile{Name: "public"}
+	}
+	return w.Args.Profiles[w.profile]
+}
+
+// client returns a wormhole client that talks to the servers of the current profile
+func (w *Controller) client() wormhole.Client {
+	return w.currentProfile().client()
+}
+
 func (w *Controller) Start(app gowid.IApp) {
 	app.Run(gowid.RunFunction(func(app gowid.IApp) {
-		if w.Args.Code == "" {
+		switch {
+		case w.Args.Mode == ModeSendFile, w.Args.Mode == ModeSendDirectory:
+			w.doPickFile(w.Args.StartDir, app)
+		case w.Args.Mode == ModeSendText:
+			w.doEditText(pasteBuffer(), app)
+		case w.Args.Mode == ModeHistory:
+			w.doHistory(app)
+		case len(w.Args.Hints) > 1:
+			w.doPickCode(app)
+		case w.Args.Code == "":
 			w.noCode(app)
-		} else {
+		default:
 			w.displayCode(app)
 		}
 	}))
 }
 
+// Cancel aborts the in-flight transfer, if there is one, and returns true. The goroutines
+// doing the transfer notice the cancelled context, remove anything partially written and
+// then display the outcome. Must be called from the UI goroutine.
+func (w *Controller) Cancel(app gowid.IApp) bool {
+	if !w.inTransfer {
+		return false
+	}
+	w.inTransfer = false
+	w.cancel()
+	return true
+}
+
+func (w *Controller) cancelled() bool {
+	return w.ctx.Err() != nil
+}
+
 //======================================================================
 
 func makeTxtDialog(txt string, buttons ...dialog.Button) *dialog.Widget {
@@ -91,6 +190,16 @@ func makeTxtDialog(txt string, buttons ...dialog.Button) *dialog.Widget {
 }
 
 func makeDialog(w gowid.IWidget, wid gowid.IWidgetDimension, buttons ...dialog.Button) *dialog.Widget {
+	return makeDialogExt(w, wid, false, buttons...)
+}
+
+// makeInputDialog is for dialogs holding something to interact with other than the buttons
+// e.g. a file browser. Focus starts on that widget rather than the first button.
+func makeInputDialog(w gowid.IWidget, wid gowid.IWidgetDimension, buttons ...dialog.Button) *dialog.Widget {
+	return makeDialogExt(w, wid, true, buttons...)
+}
+
+func makeDialogExt(w gowid.IWidget, wid gowid.IWidgetDimension, focusWidget bool, buttons ...dialog.Button) *dialog.Widget {
 	d := &dialog.Widget{}
 
 	for _, b := range buttons {
@@ -108,6 +217,7 @@ func makeDialog(w gowid.IWidget, wid gowid.IWidgetDimension, buttons ...dialog.B
 			Buttons:         buttons,
 			NoEscapeClose:   true,
 			NoShadow:        true,
+			FocusOnWidget:   focusWidget,
 			BackgroundStyle: gowid.MakePaletteRef("dialog"),
 			BorderStyle:     gowid.MakePaletteRef("dialog"),
 			ButtonStyle:     gowid.MakePaletteRef("dialog-button"),
@@ -148,6 +258,20 @@ func (w quit) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface{})
 
 //======================================================================
 
+type cancelTransfer struct {
+	common
+	*Controller
+}
+
+// Hit Cancel while the transfer is happening. If it's already over, just quit.
+func (w cancelTransfer) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface{}) {
+	if !w.Cancel(app) {
+		app.Quit()
+	}
+}
+
+//======================================================================
+
 type showCodeOk struct {
 	common
 	*Controller
@@ -155,338 +279,116 @@ type showCodeOk struct {
 
 // Show the code - hit Ok button
 func (w showCodeOk) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface{}) {
-	var client wormhole.Client
+	client := w.client()
+
+	// Already hit Ok - waiting for the sender
+	if w.inTransfer {
+		return
+	}
+	w.inTransfer = true
+	w.startRecord(historyEntry{Direction: "receive", Nameplate: nameplate(w.Args.Code)})
 
 	// goroutine so I don't block ui goroutine
 	go func() {
-		ctx := context.Background()
-		msg, err := client.Receive(ctx, w.Args.Code)
+		msg, err := client.Receive(w.ctx, w.Args.Code)
 		reject := true
 
 		if err != nil {
 			app.Run(gowid.RunFunction(func(app gowid.IApp) {
 				w.previous.Close(app)
-				w.doReceiveError(err, app)
+				if w.cancelled() {
+					w.doCancelled(app)
+				} else {
+					w.doReceiveError(err, app)
+				}
 			}))
 			return
 		}
 
+		w.record.Type = Transfer(msg.Type).String()
+		w.record.Name = msg.Name
+		w.record.Size = msg.UncompressedBytes64
+
+		// Files and directories are only ever created relative to this, by a name checked here
+		var sd *saveDir
+
 		defer func() {
 			//fmt.Fprintf(os.Stderr, "GCLA: will I reject? reject is %v\n", reject)
 			if reject {
 				msg.Reject()
+				// Otherwise the goroutines doing the transfer close it when they're done
+				if sd != nil {
+					sd.Close()
+				}
 			}
 		}()
 
-		switch msg.Type {
-		case wormhole.TransferText:
-
-			// Wormhole william doesn't allow rejecting text message
-			// transfers
-			reject = false
-
-			spin := spinner.New(spinner.Options{
-				Styler: gowid.MakePaletteRef("progress-spinner"),
-			})
-
-			app.Run(gowid.RunFunction(func(app gowid.IApp) {
-				w.previous.Close(app)
-				w.doSpin(spin, app)
-			}))
-
-			done := make(chan struct{})
-			var transferredMessage []byte
-
-			go func() {
-				transferredMessage, err = ioutil.ReadAll(msg)
-
-				defer close(done)
-
-				if err != nil {
-					app.Run(gowid.RunFunction(func(app gowid.IApp) {
-						w.previous.Close(app)
-						w.doTextTransferError(err, app)
-					}))
-					return
-				}
-
-				// Artificial delay makes a nicer experience
-				time.Sleep(1000 * time.Millisecond)
-			}()
-
-			go func() {
-				c := time.Tick(100 * time.Millisecond)
-			loop:
-				for {
-					select {
-					case <-done:
-						app.Run(gowid.RunFunction(func(app gowid.IApp) {
-							w.previous.Close(app)
-							w.doMessageThenQuit(string(transferredMessage), "Quit", app)
-						}))
-						break loop
-					case <-c:
-						app.Run(gowid.RunFunction(func(app gowid.IApp) {
-							spin.Update()
-						}))
-					}
-				}
-			}()
-
-		case wormhole.TransferFile:
-			prog := progress.New(progress.Options{
-				Normal:   gowid.MakePaletteRef("progress-default"),
-				Complete: gowid.MakePaletteRef("progress-complete"),
-			})
-
-			app.Run(gowid.RunFunction(func(app gowid.IApp) {
-				w.previous.Close(app)
-				w.doProg(msg.Name, Transfer(msg.Type), prog, app)
-				//w.InTransfer = true
-			}))
-
-			done := make(chan struct{})
-			read := 0
-
-			// Only set if dir or file
-			savedFilename := filepath.Join(w.Args.SaveDir, msg.Name)
-			if !w.Args.Overwrite && fileExists(savedFilename) {
-				app.Run(gowid.RunFunction(func(app gowid.IApp) {
-					w.previous.Close(app)
-					w.doNoOverwrite(savedFilename, app)
-				}))
-				return
+		if msg.Type != wormhole.TransferText {
+			err = checkName(msg.Name)
+			if err == nil {
+				sd, err = openSaveDir(w.Args.SaveDir)
 			}
-
-			f, err := os.Create(savedFilename)
 			if err != nil {
 				app.Run(gowid.RunFunction(func(app gowid.IApp) {
 					w.previous.Close(app)
-					w.doFileCreateError(savedFilename, err, app)
+					w.doError(err, app)
 				}))
 				return
 			}
 
-			reject = false
-
-			go func() {
-				_, err = io.Copy(f, &progReader{read: &read, Reader: msg})
-
-				defer func() {
-					f.Close()
-					close(done)
-				}()
-
-				if err != nil {
-					app.Run(gowid.RunFunction(func(app gowid.IApp) {
-						w.previous.Close(app)
-						w.doFileTransferError(savedFilename, err, app)
-					}))
-					return
-				}
-			}()
-
-			go func() {
-				c := time.Tick(250 * time.Millisecond)
-			loop:
-				for {
-					select {
-					case <-done:
-						app.Run(gowid.RunFunction(func(app gowid.IApp) {
-							prog.SetTarget(app, int(msg.UncompressedBytes64))
-							prog.SetProgress(app, int(msg.UncompressedBytes64))
-
-							// Delay at 100% is nice
-							time.AfterFunc(1*time.Second, func() {
-								app.Run(gowid.RunFunction(func(app gowid.IApp) {
-									//w.InTransfer = false
-									w.previous.Close(app)
-
-									if w.Args.OpenCmd == "" {
-										w.doSavedAs(savedFilename, app)
-									} else {
-										if w.Args.NoAskOpen {
-											w.doOpen(savedFilename, app)
-										} else {
-											w.doAskToOpen(savedFilename, app)
-										}
-									}
-								}))
-							})
-
-						}))
-						break loop
-					case <-c:
-						app.Run(gowid.RunFunction(func(app gowid.IApp) {
-							prog.SetTarget(app, int(msg.UncompressedBytes64))
-							prog.SetProgress(app, read)
-						}))
-					}
-				}
-			}()
-
-		case wormhole.TransferDirectory:
-
-			dirName := filepath.Join(w.Args.SaveDir, msg.Name)
-
-			err = os.Mkdir(dirName, 0777)
+			// Better to say so now than to run out of room halfway
+			err = sd.checkSpace(spaceNeeded(msg))
+			// Don't accept a directory that's already too big
+			if err == nil && msg.Type == wormhole.TransferDirectory {
+				err = w.Args.Limits.checkOffer(msg.TransferBytes64, msg.UncompressedBytes64, msg.FileCount)
+			}
 			if err != nil {
 				app.Run(gowid.RunFunction(func(app gowid.IApp) {
 					w.previous.Close(app)
-					w.doError(err, app)
+					w.doLimitExceeded(fmt.Sprintf("%q", msg.Name), err, app)
 				}))
 				return
 			}
 
-			tmpFile, err := ioutil.TempFile(w.Args.SaveDir, fmt.Sprintf("%s.zip.tmp", msg.Name))
-			if err != nil {
+			// The receive policy can decide for the user, or not give them the choice. Otherwise
+			// let them see what's coming before taking it.
+			switch action, reason := w.Args.Policy.decide(msg, w.Args.Host); action {
+			case policyReject:
 				app.Run(gowid.RunFunction(func(app gowid.IApp) {
 					w.previous.Close(app)
-					w.doError(err, app)
+					w.doLimitExceeded(fmt.Sprintf("%q", msg.Name), policyError{reason: reason}, app)
 				}))
 				return
-			}
-
-			prog := progress.New(progress.Options{
-				Normal:   gowid.MakePaletteRef("progress-default"),
-				Complete: gowid.MakePaletteRef("progress-complete"),
-			})
-
-			app.Run(gowid.RunFunction(func(app gowid.IApp) {
-				w.previous.Close(app)
-				w.doProg(msg.Name, Transfer(msg.Type), prog, app)
-			}))
-
-			done := make(chan struct{})
-			read := 0
-
-			reject = false
-
-			go func() {
-
-				errme := func(w showCodeOk, err error, app gowid.IApp) {
+			case policyAsk:
+				if ok, err := w.confirmOffer(msg, app); !ok {
 					app.Run(gowid.RunFunction(func(app gowid.IApp) {
 						w.previous.Close(app)
-						w.doError(err, app)
-					}))
-				}
-
-				defer func() {
-					tmpFile.Close()
-					os.Remove(tmpFile.Name())
-					close(done)
-				}()
-
-				n, err := io.Copy(tmpFile, &progReader{read: &read, Reader: msg})
-
-				if err != nil {
-					app.Run(gowid.RunFunction(func(app gowid.IApp) {
-						w.previous.Close(app)
-						w.doFileTransferError(msg.Name, err, app)
+						w.doNotReceived(msg.Name, err, app)
 					}))
 					return
 				}
-
-				tmpFile.Seek(0, io.SeekStart)
-				zr, err := zip.NewReader(tmpFile, int64(n))
-				if err != nil {
-					app.Run(gowid.RunFunction(func(app gowid.IApp) {
-						w.previous.Close(app)
-						w.doError(err, app)
-					}))
-					return
-				}
-
-				for _, zf := range zr.File {
-					p, err := filepath.Abs(filepath.Join(dirName, zf.Name))
-					if err != nil {
-						errme(w, err, app)
-						return
-					}
-
-					if !strings.HasPrefix(p, dirName) {
-						app.Run(gowid.RunFunction(func(app gowid.IApp) {
-							w.previous.Close(app)
-							w.doMessageThenQuit(fmt.Sprintf("Dangerous filename found: %s", zf.Name), "Quit", app)
-						}))
-						return
-					}
-
-					rc, err := zf.Open()
-					if err != nil {
-						app.Run(gowid.RunFunction(func(app gowid.IApp) {
-							w.previous.Close(app)
-							w.doMessageThenQuit(fmt.Sprintf("%s open failed: %v", zf.Name, err), "Quit", app)
-						}))
-						return
-					}
-
-					dir := filepath.Dir(p)
-					err = os.MkdirAll(dir, 0777)
-					if err != nil {
-						errme(w, err, app)
-						return
-					}
-
-					f, err := os.Create(p)
-					if err != nil {
-						errme(w, err, app)
-						return
-					}
-
-					_, err = io.Copy(f, rc)
-					if err != nil {
-						errme(w, err, app)
-						return
-					}
-
-					err = f.Close()
-					if err != nil {
-						errme(w, err, app)
-						return
-					}
-
-					rc.Close()
-				}
-			}()
-
-			go func() {
-				c := time.Tick(250 * time.Millisecond)
-			loop:
-				for {
-					select {
-					case <-done:
-						app.Run(gowid.RunFunction(func(app gowid.IApp) {
-							prog.SetTarget(app, int(msg.UncompressedBytes64))
-							prog.SetProgress(app, int(msg.UncompressedBytes64))
-
-							// Delay at 100% is nice
-							time.AfterFunc(1*time.Second, func() {
-								app.Run(gowid.RunFunction(func(app gowid.IApp) {
-									w.previous.Close(app)
-									w.doSavedAs(dirName, app)
-								}))
-							})
-
-						}))
-						break loop
-					case <-c:
-						app.Run(gowid.RunFunction(func(app gowid.IApp) {
-							prog.SetTarget(app, int(msg.UncompressedBytes64))
-							prog.SetProgress(app, read)
-						}))
-					}
-				}
-			}()
-
+			}
 		}
 
+		switch msg.Type {
+		case wormhole.TransferText:
+			// Wormhole william doesn't allow rejecting text message
+			// transfers
+			reject = false
+			w.receiveText(msg, app)
+		case wormhole.TransferFile:
+			reject = !w.receiveFile(msg, sd, app)
+		case wormhole.TransferDirectory:
+			reject = !w.receiveDirectory(msg, sd, app)
+		}
 	}()
 }
 
 //======================================================================
 
 func (w *Controller) openSaveError(savedFilename string, cmd string, err error, app gowid.IApp) {
+	w.inTransfer = false
+
 	txt := fmt.Sprintf("Error opening: %s: %v", cmd, err)
 	d := makeTxtDialog(txt,
 		dialog.Button{
@@ -512,31 +414,40 @@ func (w savedAs) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface
 	w.doSavedAs(w.savedFilename, app)
 }
 
+// doSavedAs says where something received went and, if it's just been received, what its size
+// and SHA-256 are.
 func (w *Controller) doSavedAs(savedFilename string, app gowid.IApp) {
-	w.doMessageThenQuit(fmt.Sprintf("Saved as %s", savedFilename), "Ok", app)
+	txt := fmt.Sprintf("Saved as %q", savedFilename)
+	if w.verified != nil {
+		txt += "\n" + w.verified.String()
+	}
+	w.doMessageThenQuit(txt, "Ok", app)
 }
 
 //======================================================================
 
-func (w *Controller) doProg(name string, trans Transfer, prog *progress.Widget, app gowid.IApp) {
-	txt := fmt.Sprintf("Transferring %s %s...", trans, name)
+// doProg shows how a transfer is going. stats is kept up to date by the caller, with the
+// amount received, the speed and how long is left.
+func (w *Controller) doProg(name string, trans Transfer, prog *progress.Widget, stats *text.Widget, app gowid.IApp) {
+	txt := fmt.Sprintf("Transferring %s %q...", trans, name)
 
 	rows := pile.NewFlow(
 		text.New(txt),
 		divider.NewBlank(),
+		stats,
+		divider.NewBlank(),
 		prog,
 	)
 
 	d := makeDialog(rows,
 		gowid.RenderFlow{},
 		dialog.Button{
-			Msg: "Cancel",
-			// Can't really cancel, can't interrupt receive
-			Action: &quit{Controller: w},
+			Msg:    "Cancel",
+			Action: &cancelTransfer{Controller: w},
 		},
 	)
 
-	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: gwutil.Max(32, len(txt)+10)}, gowid.RenderFlow{}, app)
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: gwutil.Max(48, len(txt)+10)}, gowid.RenderFlow{}, app)
 }
 
 //======================================================================
@@ -554,7 +465,7 @@ func (w *Controller) doSpin(spin *spinner.Widget, app gowid.IApp) {
 		gowid.RenderFlow{},
 		dialog.Button{
 			Msg:    "Cancel",
-			Action: &quit{Controller: w},
+			Action: &cancelTransfer{Controller: w},
 		},
 	)
 
@@ -564,48 +475,151 @@ func (w *Controller) doSpin(spin *spinner.Widget, app gowid.IApp) {
 //======================================================================
 
 func (w *Controller) doReceiveError(err error, app gowid.IApp) {
+	w.finishRecord(outcomeFailed, "", err)
 	w.doMessageThenQuit(fmt.Sprintf("Error: %v", err), "Quit", app)
 }
 
 //======================================================================
 
 func (w *Controller) doFileCreateError(filename string, err error, app gowid.IApp) {
-	w.doMessageThenQuit(fmt.Sprintf("Error creating %s: %v", filename, err), "Quit", app)
+	w.finishRecord(outcomeFailed, "", err)
+	w.doMessageThenQuit(fmt.Sprintf("Error creating %q: %v", filename, err), "Quit", app)
 }
 
 //======================================================================
 
 func (w *Controller) doFileTransferError(filename string, err error, app gowid.IApp) {
-	w.doMessageThenQuit(fmt.Sprintf("Error transferring %s: %v", filename, err), "Quit", app)
+	w.finishRecord(outcomeFailed, "", err)
+	w.doMessageThenQuit(fmt.Sprintf("Error transferring %q: %v", filename, err), "Quit", app)
 }
 
 //======================================================================
 
 func (w *Controller) doTextTransferError(err error, app gowid.IApp) {
+	w.finishRecord(outcomeFailed, "", err)
 	w.doMessageThenQuit(fmt.Sprintf("Error transferring message: %v", err), "Quit", app)
 }
 
 //======================================================================
 
+// noCode lets the user type in a code that isn't on the screen e.g. one read out over the
+// phone. Tab completes the words of the code.
 func (w *Controller) noCode(app gowid.IApp) {
-	w.doMessageThenQuit("No wormhole code found!", "Quit", app)
+	txt := "No wormhole code found! Enter one:"
+
+	words := newWordList(w.Args.Words)
+	ed := edit.New(edit.Options{
+		Caption: "Code: ",
+	})
+	hint := text.New("Tab completes words.")
+
+	ok := &enterCodeOk{editor: ed, hint: hint, Controller: w}
+
+	entry := &keyCatcher{
+		IWidget: ed,
+		fn: func(app gowid.IApp, ev *tcell.EventKey) bool {
+			switch ev.Key() {
+			case tcell.KeyTab:
+				code, matches := words.complete(ed.Text())
+				ed.SetText(code, app)
+				ed.SetCursorPos(len(code), app)
+				hint.SetText(strings.Join(matches, " "), app)
+				return true
+			case tcell.KeyEnter:
+				ok.Changed(app, ed)
+				return true
+			}
+			return false
+		},
+	}
+
+	rows := pile.NewFlow(
+		text.New(txt),
+		divider.NewBlank(),
+		entry,
+		divider.NewBlank(),
+		hint,
+	)
+
+	d := makeInputDialog(rows,
+		gowid.RenderFlow{},
+		dialog.Button{
+			Msg:    "Ok",
+			Action: ok,
+		},
+		dialog.Button{
+			Msg:    "Cancel",
+			Action: &cancelTransfer{Controller: w},
+		},
+	)
+
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: gwutil.Max(60, len(txt)+10)}, gowid.RenderFlow{}, app)
+}
+
+type enterCodeOk struct {
+	common
+	editor *edit.Widget
+	hint   *text.Widget
+	*Controller
+}
+
+// Enter the code - hit Ok button
+func (w enterCodeOk) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface{}) {
+	code, err := checkCode(w.editor.Text())
+	if err != nil {
+		w.hint.SetText(fmt.Sprintf("Error: %v.", err), app)
+		return
+	}
+	w.Args.Code = code
+
+	// Same as hitting Ok on a code found in the pane
+	showCodeOk{common: w.common, Controller: w.Controller}.Changed(app, widget, data...)
+}
+
+//======================================================================
+
+// doNotReceived explains why an offer was turned down before anything was written
+func (w *Controller) doNotReceived(name string, err error, app gowid.IApp) {
+	switch {
+	case w.cancelled():
+		w.doCancelled(app)
+	case err != nil:
+		w.doError(err, app)
+	default:
+		w.finishRecord(outcomeRejected, "", nil)
+		w.doMessageThenQuit(fmt.Sprintf("Rejected %q.", name), "Quit", app)
+	}
 }
 
 //======================================================================
 
-func (w *Controller) doNoOverwrite(savedFilename string, app gowid.IApp) {
-	w.doMessageThenQuit(fmt.Sprintf("%s exists. Will not overwrite.", savedFilename), "Quit", app)
+// doLimitExceeded says why what was offered wasn't taken. what is shown as it is, so a name chosen
+// by the sender should be quoted.
+func (w *Controller) doLimitExceeded(what string, err error, app gowid.IApp) {
+	w.finishRecord(outcomeRejected, "", err)
+	w.doMessageThenQuit(fmt.Sprintf("Not receiving %s: %v", what, err), "Quit", app)
 }
 
 //======================================================================
 
 func (w *Controller) doError(err error, app gowid.IApp) {
+	w.finishRecord(outcomeFailed, "", err)
 	w.doMessageThenQuit(fmt.Sprintf("Error: %v", err), "Quit", app)
 }
 
 //======================================================================
 
+func (w *Controller) doCancelled(app gowid.IApp) {
+	w.finishRecord(outcomeCancelled, "", nil)
+	w.doMessageThenQuit("Cancelled.", "Quit", app)
+}
+
+//======================================================================
+
 func (w *Controller) doMessageThenQuit(message string, label string, app gowid.IApp) {
+	// Nothing left to cancel - Esc should quit from here
+	w.inTransfer = false
+
 	txt := fmt.Sprintf("%s", message)
 	d := makeTxtDialog(txt,
 		dialog.Button{
@@ -614,19 +628,232 @@ func (w *Controller) doMessageThenQuit(message string, label string, app gowid.I
 		},
 	)
 
-	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: len(txt) + 10}, gowid.RenderFlow{}, app)
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: textWidth(txt) + 10}, gowid.RenderFlow{}, app)
 }
 
 //======================================================================
 
-func (w *Controller) displayCode(app gowid.IApp) {
-	txt := fmt.Sprintf("%s. Proceed?", w.Args.Code)
+// doReceivedText shows a received message, with a button to copy it somewhere it can be pasted
+// from - see @wormhole-copy-to. Anything that won't fit on one line goes in the viewer.
+func (w *Controller) doReceivedText(message string, app gowid.IApp) {
+	w.inTransfer = false
+	w.finishRecord(outcomeReceived, "", nil)
+
+	if cols, _ := paneSize(); !fitsDialog(message, cols) {
+		w.doViewText(message, app)
+		return
+	}
+
+	d := makeTxtDialog(message, w.textButtons(message)...)
+
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: len(message) + 10}, gowid.RenderFlow{}, app)
+}
+
+// textButtons are the things that can be done with a received message - Paste, if
+// tmux-wormhole.sh provided a buffer to paste from, Copy, then any extra ones - and Quit.
+func (w *Controller) textButtons(message string, extra ...dialog.Button) []dialog.Button {
+	res := make([]dialog.Button, 0, len(extra)+3)
+	if w.Args.PasteBuffer != "" {
+		res = append(res, dialog.Button{
+			Msg:    "Paste",
+			Action: &pasteText{message: message, Controller: w},
+		})
+	}
+	res = append(res, dialog.Button{
+		Msg:    "Copy",
+		Action: &copyText{message: message, Controller: w},
+	})
+	res = append(res, extra...)
+	return append(res, dialog.Button{
+		Msg:    "Quit",
+		Action: &quit{Controller: w},
+	})
+}
+
+type pasteText struct {
+	common
+	message   string
+	confirmed bool
+	*Controller
+}
+
+// Message received - hit Paste. tmux-wormhole.sh pastes it into the original pane once that's
+// back, after quitting. Trailing newlines are dropped so a command isn't run as soon as it's
+// pasted - and anything with more than one line, or with control characters, must be confirmed.
+func (w pasteText) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface{}) {
+	w.previous.Close(app)
+	txt := strings.TrimRight(w.message, "\r\n")
+	if !w.confirmed && (strings.ContainsAny(txt, "\r\n") || hasControl(txt)) {
+		w.doConfirmPaste(w.message, app)
+		return
+	}
+	if err := loadBuffer(w.Args.PasteBuffer, txt); err != nil {
+		w.doTextError(w.message, fmt.Sprintf("Error pasting: %v", err), app)
+		return
+	}
+	app.Quit()
+}
+
+// hasControl returns true if s holds a control character other than tab or a newline - or
+// bytes that aren't UTF-8, which a terminal might take for one. Pasted into a shell, these can
+// run commands without a newline e.g. ESC [ 201 ~ ends a bracketed paste, and Ctrl-O runs the
+// line in bash.
+func hasControl(s string) bool {
+	for _, r := range s {
+		switch {
+		case r == '\t', r == '\r', r == '\n':
+		case r < 0x20, r == 0x7f, r >= 0x80 && r < 0xa0, r == utf8.RuneError:
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Controller) doConfirmPaste(message string, app gowid.IApp) {
+	trimmed := strings.TrimRight(message, "\r\n")
+	what := "control characters in it"
+	if lines := strings.Count(trimmed, "\n") + 1; lines > 1 {
+		what = fmt.Sprintf("%d lines", lines)
+		if hasControl(trimmed) {
+			what += ", and control characters"
+		}
+	}
+	txt := fmt.Sprintf("The message has %s. If the pane is running a shell,\npasting it could run commands. Paste anyway?", what)
 
 	d := makeTxtDialog(txt,
 		dialog.Button{
+			Msg:    "Paste",
+			Action: &pasteText{message: message, confirmed: true, Controller: w},
+		},
+		dialog.Button{
+			Msg:    "Cancel",
+			Action: &showText{message: message, Controller: w},
+		},
+	)
+
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: 70}, gowid.RenderFlow{}, app)
+}
+
+type copyText struct {
+	common
+	message string
+	*Controller
+}
+
+// Message received - hit Copy. Quit straight away, so it can be pasted.
+func (w copyText) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface{}) {
+	w.previous.Close(app)
+	if err := w.Args.CopyTo.copy(w.message); err != nil {
+		w.doTextError(w.message, fmt.Sprintf("Error copying: %v", err), app)
+		return
+	}
+	app.Quit()
+}
+
+// doTextError reports that something couldn't be done with a received message, then goes back to
+// it.
+func (w *Controller) doTextError(message string, txt string, app gowid.IApp) {
+	d := makeTxtDialog(txt,
+		dialog.Button{
+			Msg:    "Continue",
+			Action: &showText{message: message, Controller: w},
+		},
+	)
+
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: len(txt) + 10}, gowid.RenderFlow{}, app)
+}
+
+type showText struct {
+	common
+	message string
+	*Controller
+}
+
+// Couldn't copy or save - hit Continue to go back to the message
+func (w showText) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface{}) {
+	w.previous.Close(app)
+	w.doReceivedText(w.message, app)
+}
+
+//======================================================================
+
+func (w *Controller) displayCode(app gowid.IApp) {
+	server := fmt.Sprintf("Server: %v", w.currentProfile())
+	txt := fmt.Sprintf("%s. Proceed?\n%s", w.Args.Code, server)
+
+	buttons := []dialog.Button{
+		{
 			Msg:    "Ok",
 			Action: &showCodeOk{Controller: w},
 		},
+	}
+	if len(w.Args.Profiles) > 1 {
+		buttons = append(buttons, dialog.Button{
+			Msg:    "Server",
+			Action: &nextProfile{Controller: w},
+		})
+	}
+	buttons = append(buttons, dialog.Button{
+		Msg:    "Cancel",
+		Action: &cancelTransfer{Controller: w},
+	})
+
+	d := makeTxtDialog(txt, buttons...)
+
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: gwutil.Max(len(w.Args.Code)+20, len(server)+10)}, gowid.RenderFlow{}, app)
+}
+
+type nextProfile struct {
+	common
+	*Controller
+}
+
+// Show the code - hit Server button to use the next profile
+func (w nextProfile) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface{}) {
+	w.profile = (w.profile + 1) % len(w.Args.Profiles)
+	w.previous.Close(app)
+	w.displayCode(app)
+}
+
+//======================================================================
+
+// doPickCode is used when the pane holds several codes. Each is labelled in the pane, and
+// typing a label chooses that code.
+func (w *Controller) doPickCode(app gowid.IApp) {
+	txt := fmt.Sprintf("Found %d wormhole codes. Type a label to choose one.", len(w.Args.Hints))
+
+	var d *dialog.Widget
+	typed := ""
+
+	keys := &keyCatcher{
+		IWidget: text.New(txt),
+		fn: func(app gowid.IApp, ev *tcell.EventKey) bool {
+			if ev.Key() != tcell.KeyRune {
+				return false
+			}
+			typed += string(ev.Rune())
+			if code, ok := w.Args.Hints[typed]; ok {
+				d.Close(app)
+				w.Args.Code = code
+				if w.Args.OnPick != nil {
+					w.Args.OnPick(code)
+				}
+				w.displayCode(app)
+				return true
+			}
+			// Start again if nothing begins with what's been typed
+			for label := range w.Args.Hints {
+				if strings.HasPrefix(label, typed) {
+					return true
+				}
+			}
+			typed = ""
+			return true
+		},
+	}
+
+	d = makeInputDialog(keys,
+		gowid.RenderFixed{},
 		dialog.Button{
 			Msg:    "Cancel",
 			Action: &quit{Controller: w},
@@ -636,6 +863,24 @@ func (w *Controller) displayCode(app gowid.IApp) {
 	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: len(txt) + 10}, gowid.RenderFlow{}, app)
 }
 
+// keyCatcher makes a widget selectable and hands every key pressed to fn first, so a dialog
+// can react to single keypresses. If fn returns false, the wrapped widget gets the key.
+type keyCatcher struct {
+	gowid.IWidget
+	fn func(app gowid.IApp, ev *tcell.EventKey) bool
+}
+
+func (w *keyCatcher) Selectable() bool {
+	return true
+}
+
+func (w *keyCatcher) UserInput(ev interface{}, size gowid.IRenderSize, focus gowid.Selector, app gowid.IApp) bool {
+	if evk, ok := ev.(*tcell.EventKey); ok && w.fn(app, evk) {
+		return true
+	}
+	return w.IWidget.UserInput(ev, size, focus, app)
+}
+
 //======================================================================
 
 type open struct {
@@ -650,13 +895,7 @@ func (w open) Changed(app gowid.IApp, widget gowid.IWidget, data ...interface{})
 }
 
 func (w *Controller) doOpen(savedFilename string, app gowid.IApp) {
-	var shellCmd string
-	if strings.Contains(w.Args.OpenCmd, "%s") {
-		shellCmd = strings.Replace(w.Args.OpenCmd, "%s", shellescape.Quote(savedFilename), -1)
-	} else {
-		shellCmd = w.Args.OpenCmd + " " + shellescape.Quote(savedFilename)
-	}
-	err := exec.Command(w.Args.Shell, "-c", shellCmd).Run()
+	shellCmd, err := w.runOpenCmd(savedFilename)
 
 	if err == nil {
 		w.doSavedAs(savedFilename, app)
@@ -665,10 +904,26 @@ func (w *Controller) doOpen(savedFilename string, app gowid.IApp) {
 	}
 }
 
+// runOpenCmd runs @wormhole-open-cmd on path, and returns the command line it ran
+func (w *Controller) runOpenCmd(path string) (string, error) {
+	var shellCmd string
+	if strings.Contains(w.Args.OpenCmd, "%s") {
+		shellCmd = strings.Replace(w.Args.OpenCmd, "%s", shellescape.Quote(path), -1)
+	} else {
+		shellCmd = w.Args.OpenCmd + " " + shellescape.Quote(path)
+	}
+	return shellCmd, exec.Command(w.Args.Shell, "-c", shellCmd).Run()
+}
+
 //======================================================================
 
 func (w *Controller) doAskToOpen(savedFilename string, app gowid.IApp) {
-	txt := fmt.Sprintf("Open %s?", savedFilename)
+	w.inTransfer = false
+
+	txt := fmt.Sprintf("Open %q?", savedFilename)
+	if w.verified != nil {
+		txt = w.verified.String() + "\n\n" + txt
+	}
 	d := makeTxtDialog(txt,
 		dialog.Button{
 			Msg:    "Yes",
@@ -680,29 +935,108 @@ func (w *Controller) doAskToOpen(savedFilename string, app gowid.IApp) {
 		},
 	)
 
-	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: len(txt) + 10}, gowid.RenderFlow{}, app)
+	dialog.OpenExt(d, w.Lower, gowid.RenderWithUnits{U: textWidth(txt) + 10}, gowid.RenderFlow{}, app)
 }
 
 //======================================================================
 
-func fileExists(filename string) bool {
-	_, err := os.Stat(filename)
-	return !os.IsNotExist(err)
+// Names in the progress dialog are cut down to this, so the dialog doesn't change size
+const progNameWidth = 38
+
+// shortName keeps the end of name, which is the interesting part of a path
+func shortName(name string, width int) string {
+	if len(name) <= width {
+		return name
+	}
+	i := len(name) - (width - 3)
+	for i < len(name) && !utf8.RuneStart(name[i]) {
+		i++
+	}
+	return "..." + name[i:]
+}
+
+// textWidth is the length of the longest line of txt
+func textWidth(txt string) int {
+	res := 0
+	for _, line := range strings.Split(txt, "\n") {
+		res = gwutil.Max(res, len(line))
+	}
+	return res
+}
+
+// humanBytes formats a byte count for display e.g. 3.4 MB
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
 }
 
 //======================================================================
 
+// progReader counts the bytes received, for the progress bar to read as they arrive.
 type progReader struct {
-	read *int
+	read *int64
 	io.Reader
 }
 
 func (r *progReader) Read(p []byte) (n int, err error) {
 	n, err = r.Reader.Read(p)
-	(*r.read) += n
+	atomic.AddInt64(r.read, int64(n))
 	return
 }
 
+//======================================================================
+
+// ctxReader lets a blocked read be abandoned when ctx is cancelled. Once Receive has returned,
+// wormhole-william gives no way to interrupt the transit connection, so the read is done in a
+// goroutine and left behind if the user cancels; after that, every Read fails immediately.
+type ctxReader struct {
+	ctx context.Context
+	buf []byte
+	io.Reader
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func newCtxReader(ctx context.Context, r io.Reader) *ctxReader {
+	return &ctxReader{ctx: ctx, Reader: r}
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(r.buf) < len(p) {
+		r.buf = make([]byte, len(p))
+	}
+	buf := r.buf[:len(p)]
+
+	c := make(chan readResult, 1)
+	go func() {
+		n, err := r.Reader.Read(buf)
+		c <- readResult{n: n, err: err}
+	}()
+
+	select {
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	case res := <-c:
+		copy(p, buf[:res.n])
+		return res.n, res.err
+	}
+}
+
 //======================================================================
 // Local Variables:
 // mode: Go
@@ -47,12 +47,30 @@ fi
 
 set -e
 
+# receive (the default), send-file, send-text, send-dir or history - passed by the key bindings in tmux-wormhole.tmux
+TMUX_WORMHOLE_MODE="${1:-receive}"
+
 # Make sure every variable exists
 TMUX_WORMHOLE_SAVE_FOLDER="$(get-opt-value save-folder)"
 TMUX_WORMHOLE_OPEN_CMD="$(get-opt-value open-cmd)"
 TMUX_WORMHOLE_NO_DEFAULT_OPEN="$(get-opt-value no-default-open)"
 TMUX_WORMHOLE_NO_ASK_TO_OPEN="$(get-opt-value no-ask-to-open)"
 TMUX_WORMHOLE_CAN_OVERWRITE="$(get-opt-value can-overwrite)"
+TMUX_WORMHOLE_RENDEZVOUS_URL="$(get-opt-value rendezvous-url)"
+TMUX_WORMHOLE_TRANSIT_RELAY="$(get-opt-value transit-relay)"
+TMUX_WORMHOLE_PROFILES="$(get-opt-value profiles)"
+TMUX_WORMHOLE_PROFILE="$(get-opt-value profile)"
+TMUX_WORMHOLE_MAX_DIR_SIZE="$(get-opt-value max-dir-size)"
+TMUX_WORMHOLE_MAX_DIR_FILES="$(get-opt-value max-dir-files)"
+TMUX_WORMHOLE_MAX_DIR_RATIO="$(get-opt-value max-dir-ratio)"
+TMUX_WORMHOLE_COPY_TO="$(get-opt-value copy-to)"
+TMUX_WORMHOLE_NO_HISTORY="$(get-opt-value no-history)"
+TMUX_WORMHOLE_SHA256_SIDECAR="$(get-opt-value sha256-sidecar)"
+TMUX_WORMHOLE_HOOK_FILE="$(get-opt-value hook-file)"
+TMUX_WORMHOLE_HOOK_DIR="$(get-opt-value hook-dir)"
+TMUX_WORMHOLE_HOOK_TEXT="$(get-opt-value hook-text)"
+TMUX_WORMHOLE_EXTRACT_ARCHIVES="$(get-opt-value extract-archives)"
+TMUX_WORMHOLE_REMOVE_EXTRACTED_ARCHIVE="$(get-opt-value remove-extracted-archive)"
 
 # e.g. abc
 TMUX_WORMHOLE_CURRENT="$(random_token)"
@@ -60,6 +78,10 @@ TMUX_WORMHOLE_CURRENT="$(random_token)"
 # e.g. wormhole-abc
 TMUX_WORMHOLE_SESSION="wormhole-${TMUX_WORMHOLE_CURRENT}"
 
+# e.g. wormhole-abc-paste. If the user chooses to paste a received message, the plugin loads it
+# into this buffer, and it's pasted into the original pane once that's swapped back.
+TMUX_WORMHOLE_PASTE_BUFFER="${TMUX_WORMHOLE_SESSION}-paste"
+
 # e.g. /tmp/,tmux-wormhole-abc
 TMUX_WORMHOLE_TMP_FILE="$(tmp_dir)/.tmux-wormhole-${TMUX_WORMHOLE_CURRENT}"
 
@@ -590,11 +612,25 @@ IFS=, read TID TWID THEI TZOOM DUMMY \
 # inside that session will show these contents using cat > /dev/tty ; sleep
 tmux capture-pane -e -p -J -t "${TID}" > "${TMUX_WORMHOLE_TMP_FILE}"
 
+# When sending, the file browser starts in the active pane's working directory
+TMUX_WORMHOLE_START_DIR="$(tmux display-message -p -t "${TID}" '#{pane_current_path}')"
+
+# If the pane is logged in somewhere with ssh, the ssh command line - the receive policy can
+# match on the host. It's the process in the foreground of the pane's terminal.
+TMUX_WORMHOLE_PANE_TTY="$(tmux display-message -p -t "${TID}" '#{pane_tty}')"
+TMUX_WORMHOLE_SSH_CMD=$(ps -o stat=,args= -t "${TMUX_WORMHOLE_PANE_TTY#/dev/}" 2> /dev/null | \
+			    awk '$1 ~ /\+/ && $2 ~ /(^|\/)ssh$/ { $1 = "" ; print ; exit }' || true)
+
 # Strip the last newline so we don't get an extra linefeed when displaying in the gowid terminal.
 truncate -s -1 "${TMUX_WORMHOLE_TMP_FILE}"
 
-# This is passed to the gowid program - so it knows what to show the user.
-TMUX_WORMHOLE_CODE=$(grep -E -o -a "${TMUX_WORMHOLE_PGP_RE}" "${TMUX_WORMHOLE_TMP_FILE}" | tail -n 1)
+# This is passed to the gowid program - so it knows what to show the user. grep fails if
+# there's no code, which is fine - the gowid program says so, and it isn't needed to send.
+TMUX_WORMHOLE_CODE=$(grep -E -o -a "${TMUX_WORMHOLE_PGP_RE}" "${TMUX_WORMHOLE_TMP_FILE}" | tail -n 1 || true)
+
+# Every distinct code in the pane, oldest first and space-separated. If there's more than one,
+# the gowid program lets the user pick.
+TMUX_WORMHOLE_CODES=$(grep -E -o -a "${TMUX_WORMHOLE_PGP_RE}" "${TMUX_WORMHOLE_TMP_FILE}" | awk '!seen[$0]++' | tr '\n' ' ' || true)
 
 # This session is used to construct a pane that looks like the current pane, but with the
 # wormhole code highlighted. I put it under another socket so I don't have to worry about
@@ -631,16 +667,40 @@ TMUX_WORMHOLE_ORIG_WINDOW=$(tmux new-window -P -d -F '#{window_id}' -n ${TMUX_WO
 # then make sure my wormhole tmux session with pane displaying the highlighted
 # terminal contents is cleaned up.
 tmux respawn-pane -k -t "${TMUX_WORMHOLE_ORIG_WINDOW}" \
+     -e TMUX_WORMHOLE_MODE="${TMUX_WORMHOLE_MODE}" \
      -e TMUX_WORMHOLE_CODE="${TMUX_WORMHOLE_CODE}" \
+     -e TMUX_WORMHOLE_CODES="${TMUX_WORMHOLE_CODES}" \
+     -e TMUX_WORMHOLE_PGP_WORDS="${TMUX_WORMHOLE_PGP_WORD_LIST[*]}" \
+     -e TMUX_WORMHOLE_START_DIR="${TMUX_WORMHOLE_START_DIR}" \
      -e TMUX_WORMHOLE_SESSION="${TMUX_WORMHOLE_SESSION}" \
      -e TMUX_WORMHOLE_SAVE_FOLDER="${TMUX_WORMHOLE_SAVE_FOLDER}" \
      -e TMUX_WORMHOLE_OPEN_CMD="${TMUX_WORMHOLE_OPEN_CMD}" \
      -e TMUX_WORMHOLE_NO_DEFAULT_OPEN="${TMUX_WORMHOLE_NO_DEFAULT_OPEN}" \
      -e TMUX_WORMHOLE_NO_ASK_TO_OPEN="${TMUX_WORMHOLE_NO_ASK_TO_OPEN}" \
      -e TMUX_WORMHOLE_CAN_OVERWRITE="${TMUX_WORMHOLE_CAN_OVERWRITE}" \
+     -e TMUX_WORMHOLE_RENDEZVOUS_URL="${TMUX_WORMHOLE_RENDEZVOUS_URL}" \
+     -e TMUX_WORMHOLE_TRANSIT_RELAY="${TMUX_WORMHOLE_TRANSIT_RELAY}" \
+     -e TMUX_WORMHOLE_PROFILES="${TMUX_WORMHOLE_PROFILES}" \
+     -e TMUX_WORMHOLE_PROFILE="${TMUX_WORMHOLE_PROFILE}" \
+     -e TMUX_WORMHOLE_MAX_DIR_SIZE="${TMUX_WORMHOLE_MAX_DIR_SIZE}" \
+     -e TMUX_WORMHOLE_MAX_DIR_FILES="${TMUX_WORMHOLE_MAX_DIR_FILES}" \
+     -e TMUX_WORMHOLE_MAX_DIR_RATIO="${TMUX_WORMHOLE_MAX_DIR_RATIO}" \
+     -e TMUX_WORMHOLE_COPY_TO="${TMUX_WORMHOLE_COPY_TO}" \
+     -e TMUX_WORMHOLE_PASTE_BUFFER="${TMUX_WORMHOLE_PASTE_BUFFER}" \
+     -e TMUX_WORMHOLE_NO_HISTORY="${TMUX_WORMHOLE_NO_HISTORY}" \
+     -e TMUX_WORMHOLE_SHA256_SIDECAR="${TMUX_WORMHOLE_SHA256_SIDECAR}" \
+     -e TMUX_WORMHOLE_TMP_FILE="${TMUX_WORMHOLE_TMP_FILE}" \
+     -e TMUX_WORMHOLE_SSH_CMD="${TMUX_WORMHOLE_SSH_CMD}" \
+     -e TMUX_WORMHOLE_HOOK_FILE="${TMUX_WORMHOLE_HOOK_FILE}" \
+     -e TMUX_WORMHOLE_HOOK_DIR="${TMUX_WORMHOLE_HOOK_DIR}" \
+     -e TMUX_WORMHOLE_HOOK_TEXT="${TMUX_WORMHOLE_HOOK_TEXT}" \
+     -e TMUX_WORMHOLE_PANE_ID="${TID}" \
+     -e TMUX_WORMHOLE_EXTRACT_ARCHIVES="${TMUX_WORMHOLE_EXTRACT_ARCHIVES}" \
+     -e TMUX_WORMHOLE_REMOVE_EXTRACTED_ARCHIVE="${TMUX_WORMHOLE_REMOVE_EXTRACTED_ARCHIVE}" \
      /usr/bin/env bash -c "if ! $TMUX_WORMHOLE_BIN ; then echo Hit enter. ; read ; fi ; \
       tmux swap-pane -t \"${TMUX_WORMHOLE_ORIG_WINDOW}\" ; \
       [[ "$TZOOM" = "1" ]] && tmux resize-pane -Z ; \
+      tmux paste-buffer -p -d -b \"${TMUX_WORMHOLE_PASTE_BUFFER}\" -t \"${TID}\" 2> /dev/null ; \
       tmux -L wormhole kill-session -t \"${TMUX_WORMHOLE_SESSION}\" ; 
       rm -f \"${TMUX_WORMHOLE_TMP_FILE}\" "
 